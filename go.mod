@@ -1,5 +1,27 @@
 module github.com/dgryski/gttp
 
-go 1.19
+go 1.23
 
-require github.com/daviddengcn/go-colortext v1.0.0
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/daviddengcn/go-colortext v1.0.0
+	github.com/mattn/go-runewidth v0.0.15
+	github.com/quic-go/quic-go v0.54.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/net v0.28.0
+	golang.org/x/time v0.10.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/quic-go/qpack v0.5.1 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
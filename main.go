@@ -1,34 +1,254 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
+	"github.com/andybalholm/brotli"
 	ct "github.com/daviddengcn/go-colortext"
+	"github.com/mattn/go-runewidth"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 /*
 TODO:
     allow setting content-type for uploaded files
-    disable json formatting if output is not terminal (isatty)
     read password from terminal if no password given ( https://github.com/howeyc/gopass )
 */
 
+// exitDeadline is the exit status when -deadline passes, as for timeout(1)
+const exitDeadline = 124
+
+// stdout is where all output goes, so that it can be post-processed
+var stdout io.Writer = os.Stdout
+
+// useColor reports whether to color the output when -color isn't given.
+// FORCE_COLOR turns it on even when piping into something like less -R,
+// otherwise we follow NO_COLOR and whether stdout is a terminal.
+func useColor() bool {
+
+	switch os.Getenv("FORCE_COLOR") {
+	case "":
+	case "0", "false":
+		return false
+	default:
+		return true
+	}
+
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	return isTerminal(os.Stdout)
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startPager runs $PAGER, or less, with its output going to the terminal and
+// returns the writer for its input
+func startPager() (*exec.Cmd, io.WriteCloser, error) {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		// -R for our colors, -F and -X to leave short output on the screen
+		pager = "less -FRX"
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return cmd, w, nil
+}
+
+// the pager our output goes through, if -pager started one, and the
+// -highlight writer in front of it
+var (
+	pager       *exec.Cmd
+	pagerInput  io.WriteCloser
+	highlighted *highlighter
+)
+
+// waitPager writes out any final line -highlight is holding on to, then lets
+// the user finish reading the paged output.  It's safe to call more than once.
+func waitPager() {
+	if highlighted != nil {
+		highlighted.Flush()
+	}
+	if pager != nil {
+		pagerInput.Close()
+		pager.Wait()
+		pager = nil
+	}
+}
+
+// exit is os.Exit, but waits for the pager first
+func exit(code int) {
+	waitPager()
+	os.Exit(code)
+}
+
+// fatal is log.Fatal, but waits for the pager first
+func fatal(v ...interface{}) {
+	waitPager()
+	log.Fatal(v...)
+}
+
+// fatalf is log.Fatalf, but waits for the pager first
+func fatalf(format string, v ...interface{}) {
+	waitPager()
+	log.Fatalf(format, v...)
+}
+
+// flagConflicts are pairs of flags which can't be given together
+var flagConflicts = [][2]string{
+	{"headers", "body"},
+	{"raw", "color"},
+	{"raw", "headers"},
+	{"n", "color"},
+	{"only-status", "headers"},
+	{"only-status", "body"},
+	{"only-status", "trace"},
+	{"get-header", "only-status"},
+	{"get-header", "headers"},
+	{"get-header", "body"},
+	{"get-header", "trace"},
+	{"merge-pages", "headers"},
+	{"trace", "raw"},
+	{"session-resume", "repeat"},
+	{"session-resume", "interval"},
+	{"i", "headers"},
+	{"i", "body"},
+	{"include", "headers"},
+	{"include", "body"},
+	{"keys", "values"},
+	{"keys", "flatten"},
+	{"values", "flatten"},
+	{"G", "f"},
+	{"get", "f"},
+	{"http3", "proxy"},
+	{"http3", "header-order"},
+	{"http3", "alpn"},
+	{"http3", "raw-request"},
+	// quic-go dials for itself, so none of our dialer settings apply
+	{"http3", "interface"},
+	{"http3", "dns"},
+	{"http3", "keepalive"},
+	{"http3", "fallback-delay"},
+	{"http3", "h2-settings"},
+}
+
+// flagRequires are pairs of flags where the first only makes sense with the
+// second turned on
+var flagRequires = [][2]string{
+	{"merge-pages", "paginate"},
+	{"items-pointer", "merge-pages"},
+	{"next-pointer", "paginate"},
+	{"max-pages", "paginate"},
+	{"json-part", "m"},
+	{"multipart-type", "m"},
+	{"concurrency", "ndjson"},
+	{"poll-timeout", "interval"},
+	{"proto-message", "proto-descriptor"},
+}
+
+// givenFlags returns the set of flags given on the command line
+func givenFlags() map[string]bool {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// validateFlags rejects combinations of the given command line flags which
+// would otherwise be silently resolved one way or the other
+func validateFlags(given map[string]bool) error {
+
+	enabled := func(name string) bool {
+		v := flag.Lookup(name).Value.String()
+		return v != "" && v != "false"
+	}
+
+	for _, c := range flagConflicts {
+		if given[c[0]] && enabled(c[0]) && given[c[1]] && enabled(c[1]) {
+			return fmt.Errorf("-%s and -%s can't be used together", c[0], c[1])
+		}
+	}
+
+	for _, r := range flagRequires {
+		if given[r[0]] && enabled(r[0]) && !enabled(r[1]) {
+			return fmt.Errorf("-%s needs -%s", r[0], r[1])
+		}
+	}
+
+	return nil
+}
+
 type kvtype int
 
 const (
@@ -45,7 +265,77 @@ type kvpairs struct {
 	query   map[string][]string
 	body    map[string][]string
 	js      map[string]string
-	file    map[string]string // filename, not content
+	file    map[string][]string // filenames, not content
+}
+
+// stringList is a flag.Value collecting the values of a repeated flag
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// byteSize is a flag.Value for sizes like 512, 64K or 10M
+type byteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func (b byteSize) String() string {
+	for _, s := range sizeSuffixes {
+		if b >= byteSize(s.mult) && int64(b)%s.mult == 0 {
+			return strconv.FormatInt(int64(b)/s.mult, 10) + s.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(v string) error {
+	mult := int64(1)
+	v = strings.TrimSuffix(strings.ToUpper(v), "B")
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(v, s.suffix) {
+			mult = s.mult
+			v = strings.TrimSuffix(v, s.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return errors.New("bad size")
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+var envVar = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} in s with the value of the environment variable.
+// Only the braced form is expanded, so a URL's own $ characters are left
+// alone; $${NAME} is a literal ${NAME}.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envVar.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		name := m[2 : len(m)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return expanded, err
 }
 
 func unescape(s string) string {
@@ -67,6 +357,140 @@ func unescape(s string) string {
 	return string(u)
 }
 
+var standardMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "PURGE": true,
+	"TRACE": true, "OPTIONS": true, "CONNECT": true, "PATCH": true, "QUERY": true,
+}
+
+// parseMethod reports whether s looks like an HTTP method, returning it in
+// canonical form.  The standard methods are matched case-insensitively; any
+// other method must be an upper-case token so that hostnames aren't mistaken
+// for methods.
+func parseMethod(s string) (string, bool) {
+
+	if m := strings.ToUpper(s); standardMethods[m] {
+		return m, true
+	}
+
+	if s == "" {
+		return "", false
+	}
+
+	for _, c := range s {
+		switch {
+		case 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-^_`|~", c):
+		default:
+			return "", false
+		}
+	}
+
+	return s, true
+}
+
+// methodWithBody returns the method to use for a request which has a body.
+//
+// If no method was given, the request becomes a POST.  Any method given
+// explicitly is kept, so a DELETE with parameters is sent as a DELETE with a
+// body.  GET and HEAD requests with a body are almost always a mistake (query
+// parameters use ==) and so are refused unless allowGetBody is set.
+func methodWithBody(method string, methodProvided bool, allowGetBody bool) (string, error) {
+
+	if !methodProvided {
+		return "POST", nil
+	}
+
+	// the server echoes a TRACE back, and a body there isn't allowed at all
+	if method == "TRACE" {
+		return "", errors.New("refusing to send a body with TRACE")
+	}
+
+	if (method == "GET" || method == "HEAD") && !allowGetBody {
+		return "", fmt.Errorf("refusing to send a body with %s (use == for query parameters, or -allow-get-body)", method)
+	}
+
+	return method, nil
+}
+
+// multipartBody builds a multipart/related or multipart/mixed body, returning
+// it and its content type.  Any body parameters go first as a JSON part (the
+// root part, for multipart/related), followed by a part per file with its
+// content type guessed from the file extension.
+func multipartBody(subtype string, files map[string][]string, bodyparams map[string]interface{}) ([]byte, string, error) {
+
+	if subtype != "related" && subtype != "mixed" {
+		return nil, "", fmt.Errorf("unknown multipart type %q: want form-data, related or mixed", subtype)
+	}
+
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+
+	var rootType string
+
+	if len(bodyparams) > 0 {
+		js, err := json.Marshal(bodyparams)
+		if err != nil {
+			return nil, "", fmt.Errorf("error marshalling request body params: %v", err)
+		}
+		rootType = "application/json"
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {rootType},
+			"Content-ID":   {"<root>"},
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to create part: %v", err)
+		}
+		part.Write(js)
+	}
+
+	var keys []string
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for i, filename := range files[k] {
+			ctype := mime.TypeByExtension(filepath.Ext(filename))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			if rootType == "" {
+				rootType = ctype
+			}
+
+			id := k
+			if i > 0 {
+				id += "-" + strconv.Itoa(i)
+			}
+
+			part, err := writer.CreatePart(textproto.MIMEHeader{
+				"Content-Type":        {ctype},
+				"Content-ID":          {"<" + id + ">"},
+				"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"name": k, "filename": filepath.Base(filename)})},
+			})
+			if err != nil {
+				return nil, "", fmt.Errorf("unable to create part: %v", err)
+			}
+
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, "", fmt.Errorf("unable to read file: %v", err)
+			}
+			part.Write(b)
+		}
+	}
+
+	writer.Close()
+
+	params := map[string]string{"boundary": writer.Boundary()}
+	if subtype == "related" {
+		params["type"] = rootType
+	}
+
+	return buf.Bytes(), mime.FormatMediaType("multipart/"+subtype, params), nil
+}
+
 func parseKeyValue(keyvalue string) (kvtype, string, string) {
 
 	k := make([]rune, 0, len(keyvalue))
@@ -105,6 +529,247 @@ func parseKeyValue(keyvalue string) (kvtype, string, string) {
 	return kvpUnknown, "", ""
 }
 
+// looksLikeURL reports whether the argument s could be the URL rather than a
+// request item.  host:port and scheme://host parse as headers, so those are
+// told apart by the host: a dotted name or an IPv6 address.  A bare name
+// with a number, like x:1, is taken to be a header.
+func looksLikeURL(s string) bool {
+	if strings.Contains(s, "://") || strings.HasPrefix(s, "localhost") {
+		return true
+	}
+	t, k, _ := parseKeyValue(s)
+	switch t {
+	case kvpUnknown:
+		return true
+	case kvpHeader:
+		return strings.Contains(k, ".") || strings.HasPrefix(k, "[")
+	}
+	return false
+}
+
+var pathParamRE = regexp.MustCompile(`\{([^{}/]+)\}`)
+
+// expandPathParams fills the {name} placeholders in the path of the URL u,
+// from the name=value pairs in params or else from a query or body parameter
+// of the same name, which is then used up.
+func expandPathParams(u string, params []string, kvp *kvpairs) (string, error) {
+
+	// only look at the path
+	start := strings.Index(u, "://") + 3
+	if i := strings.IndexByte(u[start:], '/'); i >= 0 {
+		start += i
+	} else {
+		start = len(u)
+	}
+	end := len(u)
+	if i := strings.IndexAny(u[start:], "?#"); i >= 0 {
+		end = start + i
+	}
+
+	values := make(map[string]string)
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return "", fmt.Errorf("bad -path-param %q: want name=value", p)
+		}
+		values[k] = v
+	}
+
+	var missing []string
+	path := pathParamRE.ReplaceAllStringFunc(u[start:end], func(m string) string {
+		name := m[1 : len(m)-1]
+		if v, ok := values[name]; ok {
+			return url.PathEscape(v)
+		}
+		if vs := kvp.query[name]; len(vs) == 1 {
+			delete(kvp.query, name)
+			values[name] = vs[0]
+			return url.PathEscape(vs[0])
+		}
+		if vs := kvp.body[name]; len(vs) == 1 {
+			delete(kvp.body, name)
+			values[name] = vs[0]
+			return url.PathEscape(vs[0])
+		}
+		missing = append(missing, name)
+		return m
+	})
+
+	if missing != nil {
+		return "", fmt.Errorf("no value for path parameters: %s", strings.Join(missing, ", "))
+	}
+
+	return u[:start] + path + u[end:], nil
+}
+
+// formPart is a multipart/form-data part given with -part
+type formPart struct {
+	name        string
+	contentType string
+	filename    string
+	file        string // the contents come from this file, or stdin for "-"
+	value       string // otherwise the contents
+}
+
+// parseFormPart parses a -part value: the field name, then ';' separated
+// type= and filename= parameters, and finally either @file or =value, which
+// runs to the end so that values may contain ';'.
+func parseFormPart(s string) (formPart, error) {
+
+	bad := fmt.Errorf("bad -part %q: want name[;type=TYPE][;filename=NAME];@FILE or name[;type=TYPE];=VALUE", s)
+
+	name, rest, ok := strings.Cut(s, ";")
+	if !ok || name == "" {
+		return formPart{}, bad
+	}
+	p := formPart{name: name}
+
+	// parameters until the @file or =value, which is the rest of s
+	for rest != "" && rest[0] != '@' && rest[0] != '=' {
+		var f string
+		if f, rest, ok = strings.Cut(rest, ";"); !ok {
+			return formPart{}, bad
+		}
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "type":
+			p.contentType = v
+		case "filename":
+			p.filename = v
+		default:
+			return formPart{}, fmt.Errorf("bad -part %q: unknown parameter %q", s, k)
+		}
+	}
+
+	if rest == "" {
+		return formPart{}, bad
+	}
+
+	if rest[0] == '@' {
+		p.file = rest[1:]
+		if p.filename == "" && p.file != "-" {
+			p.filename = filepath.Base(p.file)
+		}
+		if p.contentType == "" {
+			p.contentType = "application/octet-stream"
+		}
+	} else {
+		p.value = rest[1:]
+	}
+
+	return p, nil
+}
+
+// write adds the part to w
+func (p formPart) write(w *multipart.Writer) error {
+
+	params := map[string]string{"name": p.name}
+	if p.filename != "" {
+		params["filename"] = p.filename
+	}
+	header := textproto.MIMEHeader{
+		"Content-Disposition": {mime.FormatMediaType("form-data", params)},
+	}
+	if p.contentType != "" {
+		header.Set("Content-Type", p.contentType)
+	}
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("unable to create part: %v", err)
+	}
+
+	switch p.file {
+	case "":
+		_, err = io.WriteString(part, p.value)
+	case "-":
+		_, err = io.Copy(part, os.Stdin)
+	default:
+		var f *os.File
+		if f, err = os.Open(p.file); err != nil {
+			return fmt.Errorf("unable to open file: %v", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(part, f)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write part: %v", err)
+	}
+
+	return nil
+}
+
+// checkBodySources rejects arguments which give the request body in more
+// than one way, where all but one of them would be dropped.  encoded is the
+// number of -data-urlencode fields, and multipart whether files are uploaded
+// as multipart.
+func checkBodySources(kvp *kvpairs, parts []formPart, encoded int, bodyFile, ndjson string, multipart bool) error {
+
+	raw := len(kvp.file["-"])
+	if bodyFile != "" {
+		raw++
+	}
+
+	files := len(parts)
+	for k, vs := range kvp.file {
+		if k != "-" {
+			files += len(vs)
+		}
+	}
+
+	params := len(kvp.body) + len(kvp.js)
+
+	switch {
+	case ndjson != "" && raw+files+params+encoded > 0:
+		return errors.New("the bodies come from the -ndjson file; no other body allowed")
+	case raw > 1:
+		return errors.New("only one raw body allowed, from -@file or -body-file")
+	case raw > 0 && files > 0:
+		return errors.New("files can't be uploaded along with a raw body")
+	case raw > 0 && params > 0:
+		return errors.New("body parameters can't be sent along with a raw body")
+	case raw > 0 && encoded > 0:
+		return errors.New("-data-urlencode fields can't be sent along with a raw body")
+	case encoded > 0 && (len(parts) > 0 || files > 0 && multipart):
+		return errors.New("-data-urlencode fields can't be sent in a multipart body; use -m=false to send files as form fields")
+	}
+
+	return nil
+}
+
+// checkFileSizes errors if any of the files to be sent is larger than max
+// bytes, before any of them are read.  Standard input isn't checked.
+func checkFileSizes(kvp *kvpairs, parts []formPart, bodyFile string, max int64) error {
+
+	if max <= 0 {
+		return nil
+	}
+
+	var files []string
+	for _, vs := range kvp.file {
+		files = append(files, vs...)
+	}
+	for _, p := range parts {
+		files = append(files, p.file)
+	}
+	files = append(files, bodyFile)
+
+	for _, f := range files {
+		if f == "" || f == "-" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("unable to open file: %v", err)
+		}
+		if fi.Size() > max {
+			return fmt.Errorf("%s is %d bytes, more than the %v allowed by -max-filesize", f, fi.Size(), byteSize(max))
+		}
+	}
+
+	return nil
+}
+
 func parseArgs(args []string) (*kvpairs, error) {
 
 	kvp := kvpairs{
@@ -112,7 +777,7 @@ func parseArgs(args []string) (*kvpairs, error) {
 		query:   make(map[string][]string),
 		js:      make(map[string]string),
 		body:    make(map[string][]string),
-		file:    make(map[string]string),
+		file:    make(map[string][]string),
 	}
 
 	for _, arg := range args {
@@ -132,74 +797,395 @@ func parseArgs(args []string) (*kvpairs, error) {
 			kvp.query[k] = append(vs, v)
 
 		case kvpBody:
-			vs := kvp.query[k]
+			vs := kvp.body[k]
 			kvp.body[k] = append(vs, v)
 
 		case kvpJSON:
 			kvp.js[k] = v
 
 		case kvpFile:
-			kvp.file[k] = v
+			kvp.file[k] = append(kvp.file[k], v)
 		}
 	}
 
 	return &kvp, nil
 }
 
-func addValues(values url.Values, key string, vals interface{}) {
+// readQueryFile adds the query parameters in filename to query.  The file is
+// either a JSON object, whose array values give repeated parameters, or
+// "name=value" lines, with blank lines and lines starting with '#' skipped.
+func readQueryFile(filename string, query map[string][]string) error {
 
-	switch val := vals.(type) {
-	case bool:
-		if val {
-			values.Add(key, "true")
-		} else {
-			values.Add(key, "false")
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read query file: %v", err)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		j, err := decodeJSON(b)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling query file: %v", err)
 		}
-	case string:
-		values.Add(key, val)
-	case float64:
-		values.Add(key, fmt.Sprintf("%g", val))
-	case map[string]interface{}:
-		for k := range val {
-			addValues(values, key, k)
+		obj, ok := j.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: query file isn't a JSON object", filename)
 		}
-	case []interface{}:
-		for _, v := range val {
-			addValues(values, key, v)
+		for k, v := range obj {
+			vs, ok := v.([]interface{})
+			if !ok {
+				vs = []interface{}{v}
+			}
+			for _, v := range vs {
+				query[k] = append(query[k], fmt.Sprint(v))
+			}
 		}
-	default:
-		log.Println("unknown type: ", reflect.TypeOf(val))
+		return nil
 	}
-}
-
-func main() {
 
-	postform := flag.Bool("f", false, "post form")
-	onlyHeaders := flag.Bool("headers", false, "only show headers")
-	onlyBody := flag.Bool("body", false, "only show body")
-	verbose := flag.Bool("v", false, "verbose")
-	auth := flag.String("auth", "", "username:password")
-	color := flag.Bool("color", true, "use color")
-	noFormatting := flag.Bool("n", false, "no formatting/colour")
-	rawOutput := flag.Bool("raw", false, "raw output (no headers/formatting/color)")
-	useMultipart := flag.Bool("m", true, "use multipart if uploading files")
-	timeout := flag.Duration("t", 0, "timeout (default none)")
-	insecure := flag.Bool("k", false, "allow insecure TLS")
-	useEnv := flag.Bool("e", true, "use proxies from environment")
+	for lineno, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
 
-	flag.Parse()
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("%s:%d: bad query line: %q", filename, lineno+1, line)
+		}
 
-	if *noFormatting {
-		*color = false
+		query[k] = append(query[k], v)
 	}
 
-	if *rawOutput {
-		*onlyHeaders = false
-		*onlyBody = true
+	return nil
+}
+
+// readHeaderFile adds the "Name: value" lines in filename to headers.  Blank
+// lines and lines starting with '#' are skipped.  Headers already present are
+// left alone, so those given on the command line take precedence.
+func readHeaderFile(filename string, headers map[string]string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open header file: %v", err)
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	for k := range headers {
+		seen[http.CanonicalHeaderKey(k)] = true
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return fmt.Errorf("%s:%d: bad header line: %q", filename, lineno, line)
+		}
+
+		if ck := http.CanonicalHeaderKey(k); !seen[ck] {
+			seen[ck] = true
+			headers[k] = strings.TrimSpace(v)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading header file: %v", err)
+	}
+
+	return nil
+}
+
+// urlEncodeData returns the form field for a -data-urlencode argument, which
+// takes the same forms as curl's: the content alone, =content, name=content,
+// @file or name@file.  Only the content is encoded.
+func urlEncodeData(arg string) (string, error) {
+
+	i := strings.IndexAny(arg, "=@")
+	if i < 0 {
+		return url.QueryEscape(arg), nil
+	}
+
+	name, content := arg[:i], arg[i+1:]
+	if arg[i] == '@' {
+		b, err := os.ReadFile(content)
+		if err != nil {
+			return "", fmt.Errorf("unable to read -data-urlencode file: %v", err)
+		}
+		content = string(b)
+	}
+
+	if name == "" {
+		return url.QueryEscape(content), nil
+	}
+	return name + "=" + url.QueryEscape(content), nil
+}
+
+func addValues(values url.Values, key string, vals interface{}) {
+
+	switch val := vals.(type) {
+	case bool:
+		if val {
+			values.Add(key, "true")
+		} else {
+			values.Add(key, "false")
+		}
+	case string:
+		values.Add(key, val)
+	case float64:
+		values.Add(key, fmt.Sprintf("%g", val))
+	case map[string]interface{}:
+		for k := range val {
+			addValues(values, key, k)
+		}
+	case []interface{}:
+		for _, v := range val {
+			addValues(values, key, v)
+		}
+	default:
+		log.Println("unknown type: ", reflect.TypeOf(val))
+	}
+}
+
+func main() {
+
+	postform := flag.Bool("f", false, "post form")
+	var getData bool
+	flag.BoolVar(&getData, "G", false, "send the body parameters and -data-urlencode fields in the query string of a GET, like curl -G")
+	flag.BoolVar(&getData, "get", false, "same as -G")
+	var dataURLEncode stringList
+	flag.Var(&dataURLEncode, "data-urlencode", "add a URL-encoded form field, like curl: `content`, =content, name=content, @file or name@file (may be repeated; implies -f)")
+	asHTTPie := flag.Bool("as-httpie", false, "print the equivalent HTTPie command instead of sending the request")
+	onlyHeaders := flag.Bool("headers", false, "only show headers")
+	onlyBody := flag.Bool("body", false, "only show body")
+	var include bool
+	flag.BoolVar(&include, "i", false, "show the response headers before the body, even with -raw, like curl -i")
+	flag.BoolVar(&include, "include", false, "same as -i")
+	expectContentType := flag.String("expect-content-type", "", "exit with an error unless the response has this media `type` (parameters are ignored)")
+	var assertHeaders stringList
+	flag.Var(&assertHeaders, "assert-header", "exit with an error unless the response header matches the `'Name ~ regexp'` (may be repeated)")
+	followMetaRefresh := flag.Bool("follow-meta-refresh", false, "follow <meta http-equiv=\"refresh\"> redirects in HTML responses to GET requests")
+	maxRedirects := flag.Int("max-redirects", 10, "follow at most `n` redirects")
+	headHTML := flag.Bool("head-html", false, "only show the title and meta description of text/html responses")
+	renderMarkdown := flag.Bool("render-markdown", false, "style text/markdown responses for the terminal")
+	cookieFile := flag.String("cookie", "", "send the cookies from the Netscape format cookie `file`, as written by curl -c")
+	cookieJarFile := flag.String("cookie-jar", "", "write the cookies received to `file` in Netscape format")
+	showCookiesInline := flag.Bool("show-cookies", false, "show Set-Cookie response headers decoded")
+	showCookies := flag.Bool("cookies", false, "show the cookies set by the response as a table")
+	getHeader := flag.String("get-header", "", "only show the value of the response header `name`, one per line")
+	quietOnSuccess := flag.Bool("quiet-on-success", false, "show nothing for a 2xx response, and everything otherwise")
+	onlyStatus := flag.Bool("only-status", false, "only show the response status code")
+	verbose := flag.Bool("v", false, "verbose")
+	auth := flag.String("auth", "", "username:password")
+	color := flag.Bool("color", false, "use color (default: if stdout is a terminal or FORCE_COLOR is set, and NO_COLOR isn't)")
+	noFormatting := flag.Bool("n", false, "no formatting/colour")
+	usePager := flag.Bool("pager", false, "when writing to a terminal, page the output through $PAGER (default less -FRX, which only pages output longer than a screen)")
+	rawOutput := flag.Bool("raw", false, "raw output (no headers/formatting/color)")
+	noContentLength := flag.Bool("no-content-length", false, "don't send a Content-Length for the request body; send it chunked")
+	compressedSize := flag.Bool("compressed-size", false, "decompress gzip, deflate and br responses ourselves and report the on-the-wire and decoded body sizes")
+	compressed := flag.Bool("compressed", false, "ask for a gzip, deflate or br compressed response, and decompress it")
+	forceRetry := flag.Bool("force-retry", false, "retry non-idempotent requests once on a connection reset too")
+	allowGetBody := flag.Bool("allow-get-body", false, "allow sending a request body with GET or HEAD")
+	var methodFlag string
+	flag.StringVar(&methodFlag, "X", "", "use `method` for the request, which may be any method token")
+	flag.StringVar(&methodFlag, "method", "", "same as -X")
+	useMultipart := flag.Bool("m", true, "use multipart if uploading files")
+	jsonPart := flag.String("json-part", "", "with -m, send the body parameters as one application/json part with this form field `name`")
+	multipartType := flag.String("multipart-type", "form-data", "multipart `subtype` for file uploads: form-data, related or mixed")
+	waitNotice := flag.Duration("wait-notice", 5*time.Second, "with -v, note on stderr every `duration` that we're still waiting for a response")
+	deadline := flag.String("deadline", "", "give up at `time` (RFC 3339), exiting with status 124")
+	timeout := flag.Duration("t", 0, "timeout (default none)")
+	insecure := flag.Bool("k", false, "allow insecure TLS")
+	cacheDir := flag.String("cache-dir", "", "cache GET responses in `directory`, reusing them while fresh according to Cache-Control or Expires")
+	noCache := flag.Bool("no-cache", false, "with -cache-dir, revalidate or refetch rather than using a cached response")
+	validateJSON := flag.Bool("validate-json", false, "check that a JSON request body parses before sending it")
+	keyLog := flag.String("keylog", "", "append TLS session keys to `file` in NSS key log format, for Wireshark (default $SSLKEYLOGFILE)")
+	headerOrder := flag.String("header-order", "", "send these comma-separated `headers` first and in this order, over HTTP/1.1 without a proxy")
+	useHTTP3 := flag.Bool("http3", false, "make the request over HTTP/3 (QUIC)")
+	h2Settings := flag.Bool("h2-settings", false, "print the server's HTTP/2 settings, sending over x/net's HTTP/2 client rather than the one in net/http")
+	alpn := flag.String("alpn", "", "comma-separated list of `protocols` to offer with ALPN in the TLS handshake (default h2,http/1.1)")
+	noTLSResume := flag.Bool("no-tls-resume", false, "don't resume TLS sessions; each new connection does a full handshake")
+	sessionResume := flag.Bool("session-resume", false, "send the request twice, on two connections, and report whether the second resumed the TLS session")
+	var caFiles, caDirs stringList
+	flag.Var(&caFiles, "cacert", "trust the CA certificates in PEM `file` instead of the system ones (may be repeated)")
+	flag.Var(&caDirs, "capath", "trust the CA certificates in the PEM files under `dir` instead of the system ones (may be repeated)")
+	useEnv := flag.Bool("e", true, "use proxies from environment")
+	iface := flag.String("interface", "", "send from the local `address`, or the first address of the named network interface")
+	proxy := flag.String("proxy", "", "send requests through the proxy at `url`")
+	tunnel := flag.Bool("tunnel", false, "with CONNECT, copy stdin and stdout through the tunnel once it's up")
+	warnBodySize := byteSize(10 << 20)
+	flag.Var(&warnBodySize, "warn-body-size", "warn if the request body is larger than `size` (0 disables)")
+	maxFileSize := byteSize(1 << 30)
+	flag.Var(&maxFileSize, "max-filesize", "refuse to upload any file larger than `size` (0 disables)")
+	var pathParams stringList
+	flag.Var(&pathParams, "path-param", "fill the {name} placeholder in the URL path with `name=value` (may be repeated)")
+	var partArgs stringList
+	flag.Var(&partArgs, "part", "add a multipart/form-data `part`: name[;type=TYPE][;filename=NAME];@FILE or name[;type=TYPE];=VALUE, where @- is stdin (may be repeated)")
+	var queryFiles stringList
+	flag.Var(&queryFiles, "query-file", "add the query parameters in `file`, as name=value lines or a JSON object (may be repeated)")
+	var headerFiles stringList
+	flag.Var(&headerFiles, "header-file", "read `file` of 'Name: value' request headers (may be repeated)")
+	highlight := flag.String("highlight", "", "highlight text matching `regexp` in the output")
+	escapeUnicode := flag.Bool("escape-unicode", false, "escape non-ASCII characters in JSON output")
+	sortArrays := flag.Bool("sort-arrays", false, "sort JSON arrays of scalars for deterministic output")
+	maxDepth := flag.Int("max-depth", 0, "collapse JSON objects and arrays nested deeper than `n` levels")
+	foldStrings := flag.Int("fold-strings", 0, "truncate JSON string values longer than `n` characters")
+	flatten := flag.Bool("flatten", false, "print JSON responses as greppable path = value lines")
+	table := flag.Bool("table", false, "print JSON arrays of objects as a table")
+	showLinks := flag.Bool("links", false, "after a JSON response, list its HAL _links or JSON:API links")
+	csvOutput := flag.Bool("csv", false, "show JSON arrays of objects as CSV")
+	onlyKeys := flag.Bool("keys", false, "only print the keys of the JSON response")
+	onlyValues := flag.Bool("values", false, "only print the values of the JSON response")
+	recursive := flag.Bool("recursive", false, "make -keys and -values descend into nested objects and arrays")
+	var exports stringList
+	flag.Var(&exports, "export-json", "print `VAR=/json/pointer` from the response as a shell export statement (may be repeated)")
+	pointer := flag.String("pointer", "", "only print the value at this JSON `pointer` (RFC 6901) in the response")
+	rateLimitHeaders := flag.String("ratelimit-headers", "X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset,Retry-After", "comma-separated response `headers` to summarize on stderr (empty disables)")
+	signCmd := flag.String("sign-cmd", "", "run `command` with the request on stdin and add the headers it prints (see README)")
+	paginate := flag.Bool("paginate", false, "follow Link: rel=\"next\" headers (or -next-pointer) to fetch every page")
+	nextPointer := flag.String("next-pointer", "", "with -paginate, JSON `pointer` to the next page's URL in the response")
+	mergePages := flag.Bool("merge-pages", false, "with -paginate, print the items from every page as a single JSON array")
+	itemsPointer := flag.String("items-pointer", "", "with -merge-pages, JSON `pointer` to the array of items in each page")
+	maxPages := flag.Int("max-pages", 50, "with -paginate, fetch at most `n` pages")
+	trace := flag.Bool("trace", false, "dump the raw request and response instead of the formatted output")
+	repeat := flag.Int("repeat", 1, "send the request `n` times")
+	failFast := flag.Bool("fail-fast", false, "with -repeat or -ndjson, stop at the first request that fails")
+	templated := flag.Bool("template", false, "expand {{.Index}} in header values and the body, counting from 0 for each -repeat")
+	interval := flag.Duration("interval", 0, "send the request every `duration`, -repeat times or until interrupted")
+	untilChange := flag.Bool("until-change", false, "stop repeating once the response body, or the value at -pointer, changes")
+	pollTimeout := flag.Duration("poll-timeout", 0, "with -interval, give up and exit with an error after `duration`")
+	untilCond := flag.String("until", "", "stop repeating once the response meets `condition`: status=N or status!=N")
+	reqRate := flag.Float64("rate", 0, "with -repeat, send at most this many requests per second")
+	fallbackDelay := flag.Duration("fallback-delay", 0, "wait before racing a connection on the other address family (default 300ms, negative disables)")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "interval between TCP keep-alive probes (negative disables)")
+	var connectTo stringList
+	flag.Var(&connectTo, "connect-to", "connect to `host1:port1:host2:port2` when the URL is for host1:port1; an empty field matches or keeps anything (may be repeated)")
+	dnsServers := flag.String("dns", "", "comma-separated list of DNS `servers` (host:port) to resolve names with")
+	grpcWeb := flag.Bool("grpc-web", false, "send the body as a gRPC-web unary call and decode the framed response")
+	protoDescriptor := flag.String("proto-descriptor", "", "decode protobuf responses using the FileDescriptorSet in `file`")
+	protoMessage := flag.String("proto-message", "", "fully-qualified `name` of the protobuf response message type")
+	bodyFile := flag.String("body-file", "", "send the contents of `file` as the request body, with a Content-Type from its extension")
+	dumpRequestBody := flag.String("dump-request-body", "", "write the assembled request body to `file`")
+	writeOut := flag.String("write-out", "", "after the response, print `format` with %{http_code}, %{size_download}, %{time_total}, %{url_effective} and %{content_type} replaced")
+	diffURL := flag.String("diff", "", "send the request to `url` as well, and show the differences between the two response bodies")
+	ndjson := flag.String("ndjson", "", "send each line of the newline-delimited JSON `file` as its own request, printing the status of each")
+	concurrency := flag.Int("concurrency", 1, "with -ndjson, send up to `n` requests at once")
+	rawRequest := flag.String("raw-request", "", "send the HTTP request in `file` verbatim and dump the raw response")
+
+	flag.Parse()
+
+	given := givenFlags()
+	if err := validateFlags(given); err != nil {
+		fatal(err)
+	}
+
+	if !given["color"] {
+		*color = useColor()
+	}
+
+	// polling with no count keeps going until -until or an interrupt
+	forever := *interval > 0 && !given["repeat"]
+
+	var until func(*http.Response) bool
+	if *untilCond != "" {
+		var err error
+		if until, err = parseUntil(*untilCond); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *noFormatting {
+		*color = false
+	}
+
+	if *rawOutput {
+		*onlyHeaders = false
+		*onlyBody = true
 		*color = false
 		*noFormatting = true
 	}
 
+	if include {
+		*onlyBody = false
+	}
+
+	if len(exports) > 0 {
+		// nothing but the export lines, so the output can be eval'd
+		*onlyHeaders = false
+		*onlyBody = true
+	}
+
+	if *mergePages {
+		// one document, not a set of pages
+		*onlyHeaders = false
+		*onlyBody = true
+	}
+
+	var headerAsserts []headerAssertion
+	for _, a := range assertHeaders {
+		ha, err := parseHeaderAssertion(a)
+		if err != nil {
+			fatal(err)
+		}
+		headerAsserts = append(headerAsserts, ha)
+	}
+
+	var expectType string
+	if *expectContentType != "" {
+		// compare media types only; ParseMediaType lowercases them
+		t, _, err := mime.ParseMediaType(*expectContentType)
+		if err != nil {
+			fatal("bad -expect-content-type: ", err)
+		}
+		expectType = t
+	}
+
+	jsonOpts := &jsonOptions{
+		color:         *color,
+		escapeUnicode: *escapeUnicode,
+		sortArrays:    *sortArrays,
+		maxDepth:      *maxDepth,
+		foldStrings:   *foldStrings,
+		pointer:       *pointer,
+		flatten:       *flatten,
+		table:         *table,
+		csv:           *csvOutput,
+		keys:          *onlyKeys,
+		values:        *onlyValues,
+		recursive:     *recursive,
+	}
+
+	if *usePager && !*noFormatting && isTerminal(os.Stdout) {
+		var err error
+		if pager, pagerInput, err = startPager(); err != nil {
+			fatal("unable to start pager: ", err)
+		}
+		stdout, ct.Writer = pagerInput, pagerInput
+	}
+	defer waitPager()
+
+	if *highlight != "" {
+		re, err := regexp.Compile(*highlight)
+		if err != nil {
+			fatal("bad highlight regexp: ", err)
+		}
+		highlighted = &highlighter{w: stdout, re: re}
+		stdout, ct.Writer = highlighted, highlighted
+	}
+
+	var protoMsg protoreflect.MessageDescriptor
+	if *protoDescriptor != "" {
+		var err error
+		if protoMsg, err = loadProtoMessage(*protoDescriptor, *protoMessage); err != nil {
+			fatal(err)
+		}
+	}
+
 	if flag.NArg() == 0 {
 		flag.Usage()
 		return
@@ -209,9 +1195,115 @@ func main() {
 		http.DefaultClient.Timeout = *timeout
 	}
 
-	if *insecure {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true,
+	if *cacheDir != "" {
+		if err := os.MkdirAll(*cacheDir, 0700); err != nil {
+			fatal(err)
+		}
+		http.DefaultClient.Transport = &cachingTransport{
+			dir:     *cacheDir,
+			next:    http.DefaultTransport,
+			noCache: *noCache,
+			verbose: *verbose,
+		}
+	}
+
+	var jar *netscapeJar
+	if *cookieFile != "" || *cookieJarFile != "" {
+		jar = &netscapeJar{}
+		if *cookieFile != "" {
+			if err := jar.load(*cookieFile); err != nil {
+				fatal(err)
+			}
+		}
+		http.DefaultClient.Jar = jar
+	}
+
+	// saveJar writes out -cookie-jar, once we're done sending requests
+	saveJar := func() {
+		if *cookieJarFile != "" {
+			if err := jar.save(*cookieJarFile); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	http.DefaultClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > *maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", *maxRedirects)
+		}
+		for i, r := range via {
+			if r.URL.String() == req.URL.String() {
+				cycle := make([]string, 0, len(via)-i+1)
+				for _, r := range via[i:] {
+					cycle = append(cycle, r.URL.String())
+				}
+				cycle = append(cycle, req.URL.String())
+				return fmt.Errorf("redirect loop: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *insecure,
+	}
+
+	if len(caFiles) > 0 || len(caDirs) > 0 {
+		pool, err := loadCACerts(caFiles, caDirs)
+		if err != nil {
+			fatal(err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if *keyLog == "" {
+		*keyLog = os.Getenv("SSLKEYLOGFILE")
+	}
+	if *keyLog != "" {
+		f, err := os.OpenFile(*keyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fatal("unable to open key log: ", err)
+		}
+		defer f.Close()
+		log.Printf("warning: logging TLS secrets to %s; anyone with this file can decrypt the traffic", *keyLog)
+		tlsConfig.KeyLogWriter = f
+	}
+
+	// so that new connections, to the same server or after a redirect back
+	// to it, can resume an earlier session
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	if *noTLSResume {
+		tlsConfig.ClientSessionCache = nil
+		tlsConfig.SessionTicketsDisabled = true
+	}
+
+	if *sessionResume {
+		// a second request, on a new connection, to try resuming the first's session
+		*repeat = 2
+	}
+
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = tlsConfig
+
+	if *alpn != "" {
+		tlsConfig.NextProtos = strings.Split(*alpn, ",")
+		offersH2 := false
+		for _, p := range tlsConfig.NextProtos {
+			offersH2 = offersH2 || p == "h2"
+		}
+		if !offersH2 {
+			// otherwise the transport adds h2 back in to what we offer
+			t := http.DefaultTransport.(*http.Transport)
+			t.ForceAttemptHTTP2 = false
+			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+	}
+
+	if t := http.DefaultTransport.(*http.Transport); *h2Settings && t.TLSNextProto == nil {
+		// HTTP/2 connections which keep the server's settings, for us to print
+		t.TLSNextProto = settingsTLSNextProto(&http2.Transport{TLSClientConfig: tlsConfig})
+		if tlsConfig.NextProtos == nil {
+			// with a TLSNextProto of our own, the transport leaves this to us
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 		}
 	}
 
@@ -219,6 +1311,84 @@ func main() {
 		http.DefaultTransport.(*http.Transport).Proxy = nil
 	}
 
+	if *proxy != "" {
+		p, err := url.Parse(*proxy)
+		if err != nil || p.Host == "" {
+			fatalf("bad proxy url %q", *proxy)
+		}
+		http.DefaultTransport.(*http.Transport).Proxy = http.ProxyURL(p)
+	}
+
+	dialer := newDialer(*keepAlive, *fallbackDelay)
+	http.DefaultTransport.(*http.Transport).DialContext = dialer.DialContext
+
+	if *iface != "" {
+		ip, err := localIP(*iface)
+		if err != nil {
+			fatal(err)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if *dnsServers != "" {
+		dialer.Resolver = newResolver(strings.Split(*dnsServers, ","))
+	}
+
+	var connectRules []connectRule
+	if len(connectTo) > 0 {
+		for _, s := range connectTo {
+			r, err := parseConnectTo(s)
+			if err != nil {
+				fatal(err)
+			}
+			connectRules = append(connectRules, r)
+		}
+		// the URL, and so Host and SNI, stay as they are; only the dial moves
+		http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, connectAddr(connectRules, addr))
+		}
+	}
+
+	if *useHTTP3 {
+		h3 := &http3.Transport{TLSClientConfig: tlsConfig}
+		if len(connectRules) > 0 {
+			h3.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+				return quic.DialAddrEarly(ctx, connectAddr(connectRules, addr), tlsCfg, cfg)
+			}
+		}
+		if c, ok := http.DefaultClient.Transport.(*cachingTransport); ok {
+			c.next = h3
+		} else {
+			http.DefaultClient.Transport = h3
+		}
+	}
+
+	if *headerOrder != "" {
+		ordered := &orderedTransport{
+			order:     strings.Split(*headerOrder, ","),
+			dial:      http.DefaultTransport.(*http.Transport).DialContext,
+			tlsConfig: tlsConfig,
+		}
+		if c, ok := http.DefaultClient.Transport.(*cachingTransport); ok {
+			c.next = ordered
+		} else {
+			http.DefaultClient.Transport = ordered
+		}
+	}
+
+	var encodedData []string
+	for _, d := range dataURLEncode {
+		e, err := urlEncodeData(d)
+		if err != nil {
+			fatal(err)
+		}
+		encodedData = append(encodedData, e)
+	}
+	if len(encodedData) > 0 && !getData {
+		// the fields only make sense in a form
+		*postform = true
+	}
+
 	args := flag.Args()
 
 	method := "GET"
@@ -228,13 +1398,34 @@ func main() {
 		method = "POST"
 	}
 
-	switch args[0] {
-	case "GET", "HEAD", "POST", "PUT", "DELETE", "PURGE", "TRACE", "OPTIONS", "CONNECT", "PATCH":
+	// a method name followed by something else is taken as the method, so
+	// PROPFIND, MKCOL, REPORT and friends work as well as the usual ones.  A
+	// method we don't know could just as well be an upper-case host name, so
+	// it only counts if what follows it could be the URL.
+	if m, ok := parseMethod(args[0]); ok && len(args) > 1 && (standardMethods[m] || looksLikeURL(args[1])) {
+		if methodFlag != "" {
+			fatalf("method given twice: %s and -X %s", m, methodFlag)
+		}
 		methodProvided = true
-		method = args[0]
+		method = m
 		args = args[1:]
 	}
 
+	if methodFlag != "" {
+		m, ok := parseMethod(methodFlag)
+		if !ok || m != strings.ToUpper(m) {
+			fatalf("-X %s: not a valid method", methodFlag)
+		}
+		methodProvided = true
+		method = m
+	}
+
+	expanded, err := expandEnv(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	args[0] = expanded
+
 	// add http:// if we need it
 	if !strings.HasPrefix(args[0], "http://") && !strings.HasPrefix(args[0], "https://") {
 		args[0] = "https://" + args[0]
@@ -242,9 +1433,90 @@ func main() {
 	u := args[0]
 	args = args[1:]
 
-	req, err := http.NewRequest(method, u, nil)
+	if *rawRequest != "" {
+		if err := sendRawRequest(dialer, *rawRequest, u, *timeout, tlsConfig); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	kvp, err := parseArgs(args)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, f := range queryFiles {
+		if err := readQueryFile(f, kvp.query); err != nil {
+			fatal(err)
+		}
+	}
+
+	if u, err = expandPathParams(u, pathParams, kvp); err != nil {
+		fatal(err)
+	}
+
+	var parts []formPart
+	for _, p := range partArgs {
+		fp, err := parseFormPart(p)
+		if err != nil {
+			fatal(err)
+		}
+		parts = append(parts, fp)
+	}
+
+	if len(parts) > 0 && (!*useMultipart || *multipartType != "form-data") {
+		fatal("-part needs a multipart/form-data body")
+	}
+
+	if err := checkBodySources(kvp, parts, len(encodedData), *bodyFile, *ndjson, *useMultipart); err != nil {
+		fatal(err)
+	}
+
+	if err := checkFileSizes(kvp, parts, *bodyFile, int64(maxFileSize)); err != nil {
+		fatal(err)
+	}
+
+	if getData {
+		if len(kvp.file) > 0 || len(parts) > 0 || *bodyFile != "" {
+			fatal("-G can't send files in the query string")
+		}
+		values := url.Values(kvp.body)
+		for k, v := range kvp.js {
+			var vint interface{}
+			if err = json.Unmarshal([]byte(v), &vint); err != nil {
+				fatal("invalid json: ", v)
+			}
+			addValues(values, k, vint)
+		}
+		for k, vs := range values {
+			kvp.query[k] = append(kvp.query[k], vs...)
+		}
+		kvp.body = make(map[string][]string)
+		kvp.js = make(map[string]string)
+	}
+
+	// the whole run, however many requests, has to finish by -deadline
+	ctx := context.Background()
+	if *deadline != "" {
+		t, err := time.Parse(time.RFC3339, *deadline)
+		if err != nil {
+			fatal("bad -deadline: ", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, t)
+		defer cancel()
+	}
+
+	checkDeadline := func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Println("deadline exceeded")
+			exit(exitDeadline)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
 	if err != nil {
-		log.Fatal("error creating request object: ", err)
+		fatal("error creating request object: ", err)
 	}
 
 	if *auth != "" {
@@ -252,9 +1524,19 @@ func main() {
 		req.SetBasicAuth(s[0], s[1])
 	}
 
-	kvp, err := parseArgs(args)
-	if err != nil {
-		log.Fatal(err)
+	for _, f := range headerFiles {
+		if err := readHeaderFile(f, kvp.headers); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *asHTTPie {
+		if !methodProvided {
+			// HTTPie picks GET or POST the same way we do
+			method = ""
+		}
+		fmt.Fprintln(stdout, httpieCommand(method, u, kvp, *postform, *useMultipart, *bodyFile, *auth))
+		return
 	}
 
 	var postFiles bool
@@ -272,6 +1554,15 @@ func main() {
 		req.URL.RawQuery = queryparams.Encode()
 	}
 
+	if getData && len(encodedData) > 0 {
+		fields := encodedData
+		if req.URL.RawQuery != "" {
+			fields = append([]string{req.URL.RawQuery}, fields...)
+		}
+		req.URL.RawQuery = strings.Join(fields, "&")
+		encodedData = nil
+	}
+
 	for k, v := range kvp.body {
 		if len(v) == 1 {
 			bodyparams[k] = v[0]
@@ -283,360 +1574,4075 @@ func main() {
 	for k, v := range kvp.js {
 		var vint interface{}
 		if err = json.Unmarshal([]byte(v), &vint); err != nil {
-			log.Fatal("invalid json: ", v)
+			fatal("invalid json: ", v)
 		}
 		bodyparams[k] = vint
 	}
 
 	// if we have at least one file, maybe upload with multipart
-	postFiles = len(kvp.file) > 0
+	postFiles = len(kvp.file) > 0 || len(parts) > 0
+
+	if v, ok := kvp.file["-"]; ok {
+		rawBodyFilename = v[0]
+		// but we're no longer posting files
+		postFiles = false
+	}
 
-	for k, v := range kvp.file {
-		if k == "-" {
-			rawBodyFilename = v
-			// but we're no longer posting files
-			postFiles = false
+	rawBodyType := "application/octet-stream"
+	if *bodyFile != "" {
+		rawBodyFilename = *bodyFile
+		postFiles = false
+		if t := mime.TypeByExtension(filepath.Ext(*bodyFile)); t != "" {
+			rawBodyType = t
 		}
 	}
 
 	// assemble the body
 
 	var body []byte
+	var streamBody io.Reader // sent as it's read, rather than from body
 
 	if rawBodyFilename != "" {
-		if len(kvp.file) > 1 {
-			log.Fatal("only one input file allowed when setting raw body")
-		}
-
-		if len(bodyparams) > 0 {
-			log.Println("extra body parameters ignored when setting raw body")
-		}
-
 		var file *os.File
 		if file, err = os.Open(rawBodyFilename); err != nil {
-			log.Fatal("unable to open file for body: ", err)
+			fatal("unable to open file for body: ", err)
 		}
 		defer file.Close()
 
-		body, err = io.ReadAll(file)
-		if err != nil {
-			log.Fatal("error reading body contents: ", err)
+		if fi, err := file.Stat(); err == nil && !fi.Mode().IsRegular() {
+			// a FIFO or process substitution may not end for a while, so
+			// pass it along as it comes, chunked, rather than wait for it
+			streamBody = file
+		} else if body, err = io.ReadAll(file); err != nil {
+			fatal("error reading body contents: ", err)
 		}
 
-		req.Header.Add("Content-Type", "application/octet-stream")
+		req.Header.Add("Content-Type", rawBodyType)
+
+	} else if postFiles && *useMultipart && *multipartType != "form-data" {
+
+		var contentType string
+		if body, contentType, err = multipartBody(*multipartType, kvp.file, bodyparams); err != nil {
+			fatal(err)
+		}
+		req.Header.Add("Content-Type", contentType)
 
 	} else if postFiles && *useMultipart {
 
 		// we have at least one file name
 		buf := &bytes.Buffer{}
 
-		// write the files
 		writer := multipart.NewWriter(buf)
-		for k, v := range kvp.file {
-			var part io.Writer
-			if part, err = writer.CreateFormFile(k, filepath.Base(v)); err != nil {
-				log.Fatal("unable to create form file: ", err)
+
+		// the body parameters as a single JSON document ahead of the files
+		if *jsonPart != "" && len(bodyparams) > 0 {
+			var js []byte
+			if js, err = json.Marshal(bodyparams); err != nil {
+				fatal("error marshalling request body params:", err)
 			}
-			var file *os.File
-			if file, err = os.Open(v); err != nil {
-				log.Fatal("unable to open file: ", err)
+			var part io.Writer
+			if part, err = writer.CreatePart(textproto.MIMEHeader{
+				"Content-Type":        {"application/json"},
+				"Content-Disposition": {mime.FormatMediaType("form-data", map[string]string{"name": *jsonPart})},
+			}); err != nil {
+				fatal("unable to create json part: ", err)
 			}
-			defer file.Close()
-			if _, err = io.Copy(part, file); err != nil {
-				log.Fatal("unable to write file: ", err)
+			part.Write(js)
+			bodyparams = nil
+		}
+
+		// write the files
+		for k, vs := range kvp.file {
+			// repeated fields become multiple parts with the same name
+			for _, v := range vs {
+				var part io.Writer
+				if part, err = writer.CreateFormFile(k, filepath.Base(v)); err != nil {
+					fatal("unable to create form file: ", err)
+				}
+				var file *os.File
+				if file, err = os.Open(v); err != nil {
+					fatal("unable to open file: ", err)
+				}
+				defer file.Close()
+				if _, err = io.Copy(part, file); err != nil {
+					fatal("unable to write file: ", err)
+				}
+			}
+		}
+
+		for _, p := range parts {
+			if err = p.write(writer); err != nil {
+				fatal(err)
+			}
+		}
+
+		// construct the extra body parameters
+		values := url.Values{}
+		for k, v := range bodyparams {
+			addValues(values, k, v)
+		}
+
+		// and write them into the body
+		for k, v := range values {
+			for _, vv := range v {
+				writer.WriteField(k, vv)
+			}
+		}
+
+		writer.Close()
+
+		body = buf.Bytes()
+		req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	} else if len(bodyparams) > 0 || len(kvp.file) > 0 || len(encodedData) > 0 {
+
+		// add our files as body values
+		for k, vs := range kvp.file {
+			var contents []interface{}
+			for _, v := range vs {
+				var file *os.File
+				if file, err = os.Open(v); err != nil {
+					fatal("unable to open file for body: ", err)
+				}
+				defer file.Close()
+
+				var val []byte
+				if val, err = io.ReadAll(file); err != nil {
+					fatal("error reading body contents: ", err)
+				}
+				if warnBodySize > 0 && int64(len(val)) > int64(warnBodySize) {
+					log.Printf("warning: embedding %s (%d bytes) in the request body as a string; use -m to upload it as multipart", v, len(val))
+				}
+				// string so that we get file contents and not base64 encoded contents
+				contents = append(contents, string(val))
+			}
+			if len(contents) == 1 {
+				bodyparams[k] = contents[0]
+			} else {
+				bodyparams[k] = contents
+			}
+		}
+
+		if *postform {
+			values := url.Values{}
+			for k, v := range bodyparams {
+				addValues(values, k, v)
+			}
+			fields := encodedData
+			if len(values) > 0 {
+				fields = append([]string{values.Encode()}, fields...)
+			}
+			body = []byte(strings.Join(fields, "&"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			body, err = json.Marshal(bodyparams)
+			if err != nil {
+				fatal("error marshalling request body params:", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+
+	if *grpcWeb {
+		// the body is the serialized protobuf message, which we wrap in a
+		// gRPC frame: a flags byte and a big-endian length
+		frame := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		body = append(frame, body...)
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		req.Header.Set("X-Grpc-Web", "1")
+	}
+
+	if warnBodySize > 0 && int64(len(body)) > int64(warnBodySize) {
+		log.Printf("warning: request body is %d bytes", len(body))
+	}
+
+	if *dumpRequestBody != "" {
+		if streamBody != nil {
+			fatal("-dump-request-body can't keep a copy of a body streamed from a pipe")
+		}
+		if err := os.WriteFile(*dumpRequestBody, body, 0644); err != nil {
+			fatal("unable to dump request body: ", err)
+		}
+	}
+
+	// an explicit GET or HEAD with nothing to send stays body-less, rather
+	// than being refused or going out with a Content-Length of 0
+	if len(body) == 0 && methodProvided && (method == "GET" || method == "HEAD") {
+		body = nil
+	}
+
+	if body != nil {
+		if req.Method, err = methodWithBody(method, methodProvided, *allowGetBody); err != nil {
+			fatal(err)
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			if len(body) == 0 {
+				// so that we still send Content-Length: 0
+				return http.NoBody, nil
+			}
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+		req.ContentLength = int64(len(body))
+	}
+
+	if streamBody != nil {
+		if *repeat > 1 || forever {
+			fatal("a body streamed from a pipe can only be sent once")
+		}
+		if req.Method, err = methodWithBody(method, methodProvided, *allowGetBody); err != nil {
+			fatal(err)
+		}
+		req.Body = io.NopCloser(streamBody)
+		req.ContentLength = -1
+	}
+
+	defaultHeaders := map[string]string{
+		"User-Agent": "gttp http for gophers",
+		"Accept":     "*/*",
+		"Host":       req.URL.Host,
+	}
+
+	if *compressed || *compressedSize {
+		// asking for it ourselves stops the transport decompressing for us
+		defaultHeaders["Accept-Encoding"] = "gzip, deflate, br"
+	}
+
+	for k, v := range defaultHeaders {
+		req.Header.Set(k, v)
+	}
+
+	for k, v := range kvp.headers {
+		req.Header.Set(k, v)
+	}
+
+	if *validateJSON && body != nil && isJSON(req.Header.Get("Content-Type")) {
+		if err := checkJSON(body); err != nil {
+			fatal("invalid JSON request body: ", err)
+		}
+	}
+
+	var reqTemplate *requestTemplate
+	if *templated {
+		if reqTemplate, err = newRequestTemplate(kvp.headers, body); err != nil {
+			fatal(err)
+		}
+	}
+
+	var limiter *rate.Limiter
+	if *reqRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*reqRate), 1)
+	}
+
+	if req.Method == "CONNECT" {
+		status, err := connectTunnel(dialer, req, *timeout, tlsConfig, *tunnel, *color)
+		if err != nil {
+			fatal(err)
+		}
+		if status != http.StatusOK {
+			exit(1)
+		}
+		return
+	}
+
+	if *diffURL != "" {
+		other, err := expandEnv(*diffURL)
+		if err != nil {
+			fatal(err)
+		}
+		if !strings.HasPrefix(other, "http://") && !strings.HasPrefix(other, "https://") {
+			other = "https://" + other
+		}
+		same, err := diffResponses(jsonOpts, req, body, *signCmd, other)
+		if err != nil {
+			checkDeadline()
+			fatal(err)
+		}
+		saveJar()
+		if !same {
+			exit(1)
+		}
+		return
+	}
+
+	if *ndjson != "" {
+		lines, err := readLines(*ndjson)
+		if err != nil {
+			fatal(err)
+		}
+		if req.Method, err = methodWithBody(method, methodProvided, *allowGetBody); err != nil {
+			fatal(err)
+		}
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		status := postLines(req, lines, *signCmd, *concurrency, limiter, *failFast)
+		saveJar()
+		exit(status)
+	}
+
+	// which address we ended up connected to, for -v and -h2-settings
+	var connInfo httptrace.GotConnInfo
+	if *verbose || *h2Settings {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { connInfo = info },
+		}))
+	}
+
+	// fetch sends req and prints the response.  It returns the response along
+	// with its body, if that was read.
+	fetch := func() (*http.Response, []byte) {
+
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+
+		sent := body
+		if *signCmd != "" {
+			if sent, err = signRequest(*signCmd, req, body); err != nil {
+				fatal(err)
+			}
+		}
+
+		if *noContentLength && req.Body != nil {
+			// unknown length, so the body is sent chunked
+			req.ContentLength = -1
+		}
+
+		if *verbose {
+			printRequestHeaders(*color, req)
+			switch {
+			case streamBody != nil:
+				// sent as it's read, so there's nothing to show yet
+			case !*noFormatting && isJSON(req.Header.Get("Content-Type")):
+				if err := printJSONBody(jsonOpts, sent); err != nil {
+					// not our place to refuse it; show it as it is
+					stdout.Write(sent)
+				}
+			default:
+				stdout.Write(sent)
+			}
+			stdout.Write([]byte{'\n', '\n'})
+		}
+
+		if *trace {
+			dump, err := httputil.DumpRequestOut(req, true)
+			if err != nil {
+				fatal("error dumping request:", err)
+			}
+			writeDump(dump)
+		}
+
+		if *verbose {
+			if d, ok := requestDeadline(req, *timeout); ok {
+				log.Printf("deadline: %s (in %s)", d.Format(time.RFC3339), time.Until(d).Round(time.Millisecond))
+			}
+		}
+
+		var waiting chan struct{}
+		if *verbose && *waitNotice > 0 {
+			waiting = make(chan struct{})
+			go stillWaiting(waiting, *waitNotice)
+		}
+
+		response, err := http.DefaultClient.Do(req)
+
+		// most likely a pooled connection the server had already closed.  A
+		// body streamed from a pipe has already been read, so can't be resent.
+		resendable := req.Body == nil || req.GetBody != nil
+		if err != nil && isConnReset(err) && (isIdempotent(req.Method) || *forceRetry) && resendable {
+			log.Println("retrying after:", err)
+			if req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
+			response, err = http.DefaultClient.Do(req)
+		}
+
+		if waiting != nil {
+			close(waiting)
+		}
+
+		if *verbose && connInfo.Conn != nil {
+			log.Println(describeConn(connInfo))
+			if err == nil && response.TLS != nil && !connInfo.Reused {
+				log.Println("TLS session resumed:", response.TLS.DidResume)
+				if p := response.TLS.NegotiatedProtocol; p != "" {
+					log.Println("negotiated protocol:", p)
+				} else {
+					log.Println("no protocol negotiated with ALPN")
+				}
+			}
+		}
+
+		if err != nil {
+			checkDeadline()
+			if *useHTTP3 {
+				fatal("error during HTTP/3 fetch (does the server support it?):", err)
+			}
+			fatal("error during fetch:", err)
+		}
+
+		if *trace {
+			dump, err := httputil.DumpResponse(response, true)
+			if err != nil {
+				fatal("error dumping response:", err)
+			}
+			response.Body.Close()
+			writeDump(dump)
+			return response, nil
+		}
+
+		if expectType != "" {
+			got, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+			if got != expectType {
+				fatalf("unexpected Content-Type %q: want %s", response.Header.Get("Content-Type"), expectType)
+			}
+		}
+
+		if c, ok := connInfo.Conn.(*settingsConn); ok {
+			settings, err := c.Settings()
+			if err != nil {
+				log.Println("unable to read HTTP/2 settings:", err)
+			} else {
+				printHTTP2Settings(*color, settings)
+			}
+		}
+
+		if *onlyStatus {
+			fmt.Fprintln(stdout, response.StatusCode)
+			// drain the body so the connection can be reused
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			return response, nil
+		}
+
+		// the transport only decodes gzip, and only when it asked for it
+		var wire *countingReader
+		if *compressed || *compressedSize || strings.EqualFold(response.Header.Get("Content-Encoding"), "br") {
+			wire = &countingReader{r: response.Body}
+			encoding := response.Header.Get("Content-Encoding")
+			r, err := decodeContentEncoding(encoding, wire)
+			if err != nil {
+				log.Println(err)
+				r = wire
+			}
+			response.Body = struct {
+				io.Reader
+				io.Closer
+			}{r, response.Body}
+		}
+
+		if *getHeader != "" {
+			for _, v := range response.Header.Values(*getHeader) {
+				fmt.Fprintln(stdout, v)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			return response, nil
+		}
+
+		if *rateLimitHeaders != "" {
+			printRateLimits(*color, response.Header, strings.Split(*rateLimitHeaders, ","))
+		}
+
+		if !*onlyBody {
+			printResponseHeaders(*color, response, *showCookiesInline)
+		}
+
+		if *showCookies {
+			if cookies := response.Cookies(); len(cookies) > 0 {
+				printTable(*color, cookieTable(cookies))
+				fmt.Fprintln(stdout)
+			}
+		}
+
+		var respBody []byte
+
+		if !*onlyHeaders {
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				checkDeadline()
+				fatal("error reading response body:", err)
+			}
+			response.Body.Close()
+			respBody = body
+
+			if *compressedSize {
+				log.Printf("response body: %d bytes on the wire, %d decoded", wire.n, len(body))
+			}
+
+			if len(exports) > 0 {
+				if err := printExports(body, exports); err != nil {
+					fatal(err)
+				}
+			} else if *mergePages {
+				// printed once we have all the pages
+			} else if *rawOutput {
+				stdout.Write(body)
+			} else if *noFormatting {
+
+				if bytes.IndexByte(body, 0) != -1 {
+					io.WriteString(stdout, msgNoBinaryToTerminal)
+				} else {
+					stdout.Write(body)
+				}
+
+			} else {
+
+				// maybe do some formatting
+
+				switch {
+
+				case strings.HasPrefix(response.Header.Get("Content-type"), "application/grpc-web"):
+					if err := printGRPCWeb(jsonOpts, protoMsg, response.Header.Get("Content-type"), body); err != nil {
+						fatal("error decoding grpc-web response: ", err)
+					}
+
+				case isProtobuf(response.Header.Get("Content-type")) && protoMsg == nil:
+					if err := printProtoRaw(0, body); err != nil {
+						io.WriteString(stdout, msgNoBinaryToTerminal)
+					}
+
+				case isJSON(response.Header.Get("Content-type")),
+					isMsgpack(response.Header.Get("Content-type")),
+					isProtobuf(response.Header.Get("Content-type")):
+
+					var j interface{}
+					if isProtobuf(response.Header.Get("Content-type")) {
+						if j, err = decodeProtobuf(protoMsg, body); err != nil {
+							fatal("error decoding protobuf response: ", err)
+						}
+					} else if isMsgpack(response.Header.Get("Content-type")) {
+						if j, err = decodeMsgpack(body); err != nil {
+							io.WriteString(stdout, msgNoBinaryToTerminal)
+							break
+						}
+					} else if j, err = decodeJSON(body); err != nil {
+						fatal("error unmarshalling response body:", err)
+					}
+
+					if err := printJSONDocument(jsonOpts, j); err != nil {
+						fatal(err)
+					}
+
+					if *showLinks {
+						printLinks(*color, jsonLinks(j))
+					}
+
+				case strings.HasPrefix(response.Header.Get("Content-type"), "message/http"):
+					// the echo of a TRACE
+					echo, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(body)))
+					if err != nil {
+						stdout.Write(body)
+						break
+					}
+					echoBody, _ := io.ReadAll(echo.Body)
+					if len(echoBody) == 0 {
+						echo.Body = nil
+					}
+					if echo.Host != "" {
+						echo.Header.Set("Host", echo.Host)
+					}
+					printRequestHeaders(*color, echo)
+					stdout.Write(echoBody)
+
+				case *renderMarkdown && *color && strings.HasPrefix(response.Header.Get("Content-type"), "text/markdown"):
+					printMarkdown(body)
+
+				case *headHTML && strings.HasPrefix(response.Header.Get("Content-type"), "text/html"):
+					title, description := htmlSummary(body)
+					if title == "" {
+						stdout.Write(body)
+						break
+					}
+					if *color {
+						ct.ChangeColor(ct.Cyan, true, ct.None, false)
+					}
+					fmt.Fprint(stdout, title)
+					if *color {
+						ct.ResetColor()
+					}
+					if description != "" {
+						fmt.Fprint(stdout, "\n", description)
+					}
+
+				case strings.HasPrefix(response.Header.Get("Content-type"), "text/csv"):
+					rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+					if err != nil || len(rows) == 0 {
+						// ragged or otherwise not something we can lay out
+						stdout.Write(body)
+						break
+					}
+					printTable(*color, rows)
+
+				case strings.HasPrefix(response.Header.Get("Content-type"), "text/"):
+					stdout.Write(body)
+
+				case bytes.IndexByte(body, 0) != -1:
+					// at least one 0 byte, assume it's binary data :/
+					// silly, but it's the same heuristic as httpie
+					io.WriteString(stdout, msgNoBinaryToTerminal)
+
+				default:
+					stdout.Write(body)
+				}
+
+				// formatted output ends with two newlines
+				stdout.Write([]byte{'\n', '\n'})
+			}
+		}
+
+		return response, respBody
+	}
+
+	var exitStatus int
+	firstURL := req.URL
+
+	var ticker *time.Ticker
+	polling := ctx
+	if *interval > 0 {
+		ticker = time.NewTicker(*interval)
+		defer ticker.Stop()
+
+		if *pollTimeout > 0 {
+			var cancel context.CancelFunc
+			polling, cancel = context.WithTimeout(polling, *pollTimeout)
+			defer cancel()
+		}
+	}
+
+	var firstSeen []byte
+
+requests:
+	for i := 0; forever || i < *repeat; i++ {
+
+		if ticker != nil && i > 0 {
+			// Ctrl-C between requests stops polling cleanly; during a
+			// request it interrupts as it always does
+			waiting, stop := signal.NotifyContext(polling, os.Interrupt)
+			select {
+			case <-ticker.C:
+				stop()
+			case <-waiting.Done():
+				stop()
+				checkDeadline()
+				if polling.Err() == context.DeadlineExceeded {
+					log.Println("gave up polling after", *pollTimeout)
+					exitStatus = 1
+				}
+				break requests
+			}
+		}
+
+		if *sessionResume && i > 0 {
+			http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		}
+
+		setRequestURL(req, firstURL)
+
+		if reqTemplate != nil {
+			rendered, err := reqTemplate.render(req, i)
+			if err != nil {
+				fatal(err)
+			}
+			if body != nil {
+				body = rendered
+				req.ContentLength = int64(len(body))
+			}
+		}
+
+		var last *http.Response
+		var lastBody []byte
+		var refreshes int
+
+		var merged []interface{}
+
+		for page := 1; ; page++ {
+
+			if limiter != nil {
+				limiter.Wait(ctx)
+			}
+			checkDeadline()
+
+			// hold on to the output until we know whether to show it
+			var held *bytes.Buffer
+			out := stdout
+			if *quietOnSuccess {
+				held = &bytes.Buffer{}
+				stdout, ct.Writer = held, held
+			}
+
+			start := time.Now()
+			response, respBody := fetch()
+
+			if held != nil {
+				stdout, ct.Writer = out, out
+				if response.StatusCode/100 != 2 {
+					out.Write(held.Bytes())
+				}
+			}
+			last, lastBody = response, respBody
+
+			if *sessionResume && i > 0 {
+				if response.TLS == nil {
+					fatal("-session-resume needs an https URL")
+				}
+				if !*verbose {
+					// -v has already said
+					log.Println("TLS session resumed:", response.TLS.DidResume)
+				}
+				if !response.TLS.DidResume {
+					exitStatus = 1
+				}
+			}
+
+			if *writeOut != "" {
+				io.WriteString(stdout, expandWriteOut(*writeOut, response, len(respBody), time.Since(start)))
+			}
+
+			if response.StatusCode >= 400 {
+				exitStatus = response.StatusCode - 399
+			}
+
+			if *getHeader != "" && len(response.Header.Values(*getHeader)) == 0 {
+				exitStatus = 1
+			}
+
+			if !checkHeaders(headerAsserts, response.Header) && exitStatus == 0 {
+				exitStatus = 1
+			}
+
+			if *failFast && exitStatus != 0 {
+				log.Printf("stopped after request %d failed: %s", i+1, response.Status)
+				break requests
+			}
+
+			if *followMetaRefresh && req.Method == "GET" {
+				if target := metaRefresh(response, respBody); target != nil {
+					if refreshes >= *maxRedirects {
+						fatalf("stopped after %d redirects", *maxRedirects)
+					}
+					refreshes++
+					setRequestURL(req, target)
+					continue
+				}
+			}
+
+			if *mergePages {
+				items, err := pageItems(respBody, *itemsPointer)
+				if err != nil {
+					fatal(err)
+				}
+				merged = append(merged, items...)
+			}
+
+			if !*paginate || page >= *maxPages {
+				break
+			}
+
+			next, err := nextPage(response, respBody, *nextPointer)
+			if err != nil {
+				fatal(err)
+			}
+			if next == nil {
+				break
+			}
+			setRequestURL(req, next)
+		}
+
+		if *mergePages {
+			if err := printJSONDocument(jsonOpts, merged); err != nil {
+				fatal(err)
+			}
+			stdout.Write([]byte{'\n', '\n'})
+		}
+
+		if until != nil && until(last) {
+			break
+		}
+
+		if *untilChange {
+			seen, err := watchedValue(lastBody, *pointer)
+			if err != nil {
+				fatal(err)
+			}
+			if i == 0 {
+				firstSeen = seen
+			} else if !bytes.Equal(seen, firstSeen) {
+				break
+			}
+		}
+	}
+
+	saveJar()
+
+	if exitStatus != 0 {
+		exit(exitStatus)
+	}
+}
+
+// parseUntil parses an -until condition, status=N or status!=N, into a
+// test of the response
+func parseUntil(cond string) (func(*http.Response) bool, error) {
+
+	negate := false
+	k, v, ok := strings.Cut(cond, "!=")
+	if ok {
+		negate = true
+	} else {
+		k, v, ok = strings.Cut(cond, "=")
+	}
+
+	if !ok || strings.TrimSpace(k) != "status" {
+		return nil, fmt.Errorf("bad -until %q: want status=N or status!=N", cond)
+	}
+
+	status, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("bad -until %q: %v", cond, err)
+	}
+
+	return func(response *http.Response) bool {
+		return (response.StatusCode == status) != negate
+	}, nil
+}
+
+// watchedValue returns what -until-change compares: body, or the JSON
+// value at pointer in it
+func watchedValue(body []byte, pointer string) ([]byte, error) {
+
+	if pointer == "" {
+		return body, nil
+	}
+
+	j, err := decodeJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling response body: %v", err)
+	}
+
+	if j, err = lookupJSONPointer(j, pointer); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(j)
+}
+
+// pageItems returns the array at pointer in the JSON document body
+func pageItems(body []byte, pointer string) ([]interface{}, error) {
+
+	j, err := decodeJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling page: %v", err)
+	}
+
+	v, err := lookupJSONPointer(j, pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("page items at %q aren't an array", pointer)
+	}
+
+	return items, nil
+}
+
+// setRequestURL points req at u
+func setRequestURL(req *http.Request, u *url.URL) {
+	req.URL = u
+	req.Host = u.Host
+	if req.Header.Get("Host") != "" {
+		req.Header.Set("Host", u.Host)
+	}
+}
+
+// requestTemplate holds the header values and body of a request as
+// templates, so that each repeat of the request can differ.
+type requestTemplate struct {
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// newRequestTemplate parses headers and body as templates.  A nil body is
+// left alone.
+func newRequestTemplate(headers map[string]string, body []byte) (*requestTemplate, error) {
+	t := &requestTemplate{headers: make(map[string]*template.Template)}
+	for k, v := range headers {
+		tmpl, err := template.New(k).Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", k, err)
+		}
+		t.headers[k] = tmpl
+	}
+	if body != nil {
+		tmpl, err := template.New("body").Parse(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("body: %v", err)
+		}
+		t.body = tmpl
+	}
+	return t, nil
+}
+
+// render sets req's headers for the index'th request and returns its body.
+func (t *requestTemplate) render(req *http.Request, index int) ([]byte, error) {
+	data := struct{ Index int }{index}
+	var buf bytes.Buffer
+	for k, tmpl := range t.headers {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		req.Header.Set(k, buf.String())
+	}
+	if t.body == nil {
+		return nil, nil
+	}
+	buf.Reset()
+	if err := t.body.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nextPage returns the URL of the page following response, or nil if there
+// isn't one.  The URL is taken from the value at the JSON pointer in body if
+// pointer is given, else from the response's Link header.
+func nextPage(response *http.Response, body []byte, pointer string) (*url.URL, error) {
+
+	var next string
+
+	if pointer != "" {
+		j, err := decodeJSON(body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find next page: %v", err)
+		}
+		// a missing or null link means we're on the last page
+		v, _ := lookupJSONPointer(j, pointer)
+		if v != nil {
+			var ok bool
+			if next, ok = v.(string); !ok {
+				return nil, fmt.Errorf("next page link at %q isn't a string", pointer)
+			}
+		}
+	} else {
+		next = linkURL(response.Header, "next")
+	}
+
+	if next == "" {
+		return nil, nil
+	}
+
+	u, err := response.Request.URL.Parse(next)
+	if err != nil {
+		return nil, fmt.Errorf("bad next page url: %v", err)
+	}
+
+	return u, nil
+}
+
+// linkURL returns the target of the RFC 8288 Link header with relation rel
+func linkURL(headers http.Header, rel string) string {
+
+	for _, h := range headers.Values("Link") {
+		for _, link := range strings.Split(h, ",") {
+			target, params, _ := strings.Cut(strings.TrimSpace(link), ";")
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(k, "rel") {
+					continue
+				}
+				for _, r := range strings.Fields(strings.Trim(v, `"`)) {
+					if strings.EqualFold(r, rel) {
+						return target[1 : len(target)-1]
+					}
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// expandWriteOut fills in the -write-out placeholders in format, along with
+// the \n, \r and \t escapes
+func expandWriteOut(format string, response *http.Response, size int, elapsed time.Duration) string {
+
+	r := strings.NewReplacer(
+		"%{http_code}", strconv.Itoa(response.StatusCode),
+		"%{size_download}", strconv.Itoa(size),
+		"%{time_total}", strconv.FormatFloat(elapsed.Seconds(), 'f', 6, 64),
+		"%{url_effective}", response.Request.URL.String(),
+		"%{content_type}", response.Header.Get("Content-Type"),
+		`\n`, "\n",
+		`\r`, "\r",
+		`\t`, "\t",
+	)
+
+	return r.Replace(format)
+}
+
+// isConnReset reports whether err is the connection being reset or closed
+// under us, which is worth one retry
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isIdempotent reports whether requests with method can safely be repeated
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// diffResponses sends req, with body, to its own URL and to other, and prints
+// a diff of the two response bodies.  Each request is signed with signCmd if
+// it's set.  It reports whether they were the same.
+func diffResponses(opts *jsonOptions, req *http.Request, body []byte, signCmd string, other string) (bool, error) {
+
+	u, err := url.Parse(other)
+	if err != nil {
+		return false, fmt.Errorf("bad -diff url: %v", err)
+	}
+
+	fetchLines := func(u *url.URL) ([]string, error) {
+		r := req.Clone(req.Context())
+		r.URL, r.Host = u, u.Host
+		if req.GetBody != nil {
+			r.Body, _ = req.GetBody()
+		}
+
+		if signCmd != "" {
+			if _, err := signRequest(signCmd, r, body); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return nil, fmt.Errorf("error during fetch: %v", err)
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response body: %v", err)
+		}
+
+		// JSON is diffed pretty-printed, so that the keys are in order and a
+		// change is confined to its own lines
+		if isJSON(response.Header.Get("Content-Type")) {
+			plain := *opts
+			plain.color = false
+			var buf bytes.Buffer
+			out := stdout
+			stdout = &buf
+			err := printJSONBody(&plain, body)
+			stdout = out
+			if err == nil {
+				body = buf.Bytes()
+			}
+		}
+
+		return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"), nil
+	}
+
+	a, err := fetchLines(req.URL)
+	if err != nil {
+		return false, err
+	}
+	b, err := fetchLines(u)
+	if err != nil {
+		return false, err
+	}
+
+	edits := diffLines(a, b)
+	same := true
+	for _, e := range edits {
+		if e.op != ' ' {
+			same = false
+			break
+		}
+	}
+
+	if !same {
+		printDiff(opts.color, req.URL.String(), u.String(), edits)
+	}
+
+	return same, nil
+}
+
+// diffEdit is a line of a diff: ' ' for a line in both, '-' for one only in
+// the first and '+' for one only in the second
+type diffEdit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the edits turning a into b, from their longest common
+// subsequence of lines
+func diffLines(a, b []string) []diffEdit {
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var edits []diffEdit
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, diffEdit{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, diffEdit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, diffEdit{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, diffEdit{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, diffEdit{'+', b[j]})
+	}
+
+	return edits
+}
+
+// diffContext is how many unchanged lines are shown around each change
+const diffContext = 3
+
+// printDiff prints edits as a unified diff between from and to, eliding
+// unchanged lines away from the changes
+func printDiff(useColor bool, from, to string, edits []diffEdit) {
+
+	// show the lines within diffContext of a change
+	show := make([]bool, len(edits))
+	for i, e := range edits {
+		if e.op == ' ' {
+			continue
+		}
+		for k := i - diffContext; k <= i+diffContext; k++ {
+			if k >= 0 && k < len(edits) {
+				show[k] = true
+			}
+		}
+	}
+
+	line := func(color ct.Color, bright bool, s string) {
+		if useColor {
+			ct.ChangeColor(color, bright, ct.None, false)
+		}
+		fmt.Fprint(stdout, s)
+		if useColor {
+			ct.ResetColor()
+		}
+		fmt.Fprintln(stdout)
+	}
+
+	line(ct.Red, true, "--- "+from)
+	line(ct.Green, true, "+++ "+to)
+
+	// the line numbers in a and b, for the hunk headers
+	var aline, bline int
+	for i := 0; i < len(edits); {
+		if !show[i] {
+			if edits[i].op != '+' {
+				aline++
+			}
+			if edits[i].op != '-' {
+				bline++
+			}
+			i++
+			continue
+		}
+
+		end := i
+		var acount, bcount int
+		for ; end < len(edits) && show[end]; end++ {
+			if edits[end].op != '+' {
+				acount++
+			}
+			if edits[end].op != '-' {
+				bcount++
+			}
+		}
+
+		line(ct.Cyan, false, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aline+1, acount, bline+1, bcount))
+		for ; i < end; i++ {
+			e := edits[i]
+			switch e.op {
+			case '-':
+				line(ct.Red, false, "-"+e.line)
+			case '+':
+				line(ct.Green, false, "+"+e.line)
+			default:
+				// dimmed, so the changes stand out
+				line(ct.Black, true, " "+e.line)
+			}
+		}
+		aline += acount
+		bline += bcount
+	}
+}
+
+// readLines returns the lines of filename, trimmed of whitespace
+func readLines(filename string) ([][]byte, error) {
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read lines: %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte{'\n'})
+	for i := range lines {
+		lines[i] = bytes.TrimSpace(lines[i])
+	}
+
+	return lines, nil
+}
+
+// postLines sends a copy of req for each of lines, with the line as the body,
+// and prints the status of each.  Blank lines are skipped.  Each request is
+// signed with signCmd if it's set.  If failFast is set, no more lines are
+// sent once a request fails.  It returns the exit status: non-zero if any
+// request failed.
+func postLines(req *http.Request, lines [][]byte, signCmd string, concurrency int, limiter *rate.Limiter, failFast bool) int {
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		exitStatus int
+		failedLine int
+	)
+
+	sem := make(chan struct{}, concurrency)
+
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		if limiter != nil {
+			limiter.Wait(context.Background())
+		}
+
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := failFast && failedLine != 0
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(n int, line []byte) {
+			defer func() { <-sem; wg.Done() }()
+
+			r := req.Clone(req.Context())
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(line)), nil
+			}
+			r.Body, _ = r.GetBody()
+			r.ContentLength = int64(len(line))
+
+			var status string
+			var response *http.Response
+			var err error
+			if signCmd != "" {
+				_, err = signRequest(signCmd, r, line)
+			}
+			if err == nil {
+				response, err = http.DefaultClient.Do(r)
+			}
+			if err == nil {
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+				status = response.Status
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(stdout, "line %d: %v\n", n, err)
+			} else {
+				fmt.Fprintf(stdout, "line %d: %s\n", n, status)
+			}
+			if err != nil || response.StatusCode >= 400 {
+				exitStatus = 1
+				if failedLine == 0 {
+					failedLine = n
+				}
+			}
+		}(i+1, line)
+	}
+
+	wg.Wait()
+
+	if failFast && failedLine != 0 {
+		log.Printf("stopped after line %d failed", failedLine)
+	}
+
+	return exitStatus
+}
+
+// headerAssertion is a response header which must match a regexp
+type headerAssertion struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parseHeaderAssertion parses an -assert-header value of the form
+// 'Name ~ regexp'
+func parseHeaderAssertion(s string) (headerAssertion, error) {
+
+	name, expr, ok := strings.Cut(s, "~")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return headerAssertion{}, fmt.Errorf("bad -assert-header %q: want 'Name ~ regexp'", s)
+	}
+
+	re, err := regexp.Compile(strings.TrimSpace(expr))
+	if err != nil {
+		return headerAssertion{}, fmt.Errorf("bad -assert-header %q: %v", s, err)
+	}
+
+	return headerAssertion{name: name, re: re}, nil
+}
+
+// checkHeaders reports whether headers satisfy all the assertions, logging
+// those which don't
+func checkHeaders(asserts []headerAssertion, headers http.Header) bool {
+
+	ok := true
+	for _, a := range asserts {
+		if got := headers.Get(a.name); !a.re.MatchString(got) {
+			log.Printf("assertion failed: header %s is %q, want a match for /%s/", a.name, got, a.re)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// describeConn says which address, and so which address family, a request
+// went to
+func describeConn(info httptrace.GotConnInfo) string {
+
+	addr := info.Conn.RemoteAddr().String()
+
+	var ip net.IP
+	switch a := info.Conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		// HTTP/3
+		ip = a.IP
+	}
+	family := "IPv6"
+	if ip.To4() != nil {
+		family = "IPv4"
+	}
+
+	s := fmt.Sprintf("connected to %s (%s", addr, family)
+	if info.Reused {
+		s += ", reused"
+	}
+
+	return s + ")"
+}
+
+// requestDeadline returns when req will be given up on, from the client
+// timeout and any deadline on its context
+func requestDeadline(req *http.Request, timeout time.Duration) (time.Time, bool) {
+
+	d, ok := req.Context().Deadline()
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); !ok || t.Before(d) {
+			d, ok = t, true
+		}
+	}
+
+	return d, ok
+}
+
+// stillWaiting logs a note every interval until done is closed
+func stillWaiting(done <-chan struct{}, interval time.Duration) {
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			log.Printf("still waiting (%s elapsed)", time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// cachingTransport keeps GET responses on disk and reuses them while they're
+// fresh.  Stale responses with an ETag or Last-Modified are revalidated with a
+// conditional request.
+type cachingTransport struct {
+	dir     string
+	next    http.RoundTripper
+	noCache bool // always revalidate or refetch
+	verbose bool
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.Method != "GET" {
+		return t.next.RoundTrip(req)
+	}
+
+	filename := cacheEntry(t.dir, req)
+
+	cached, stored, err := readCachedResponse(filename, req)
+	if err != nil {
+		// no usable entry, so fetch it as if we didn't have one
+		cached = nil
+	}
+
+	if cached != nil && !t.noCache && time.Since(stored) < cacheLifetime(cached.Header) {
+		if t.verbose {
+			log.Println("using cached response from", stored.Format(time.RFC1123))
+		}
+		return cached, nil
+	}
+
+	if cached != nil {
+		etag, modified := cached.Header.Get("ETag"), cached.Header.Get("Last-Modified")
+		if etag != "" || modified != "" {
+			req = req.Clone(req.Context())
+			if etag != "" && req.Header.Get("If-None-Match") == "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified != "" && req.Header.Get("If-Modified-Since") == "" {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+		}
+	}
+
+	response, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		response.Body.Close()
+		if t.verbose {
+			log.Println("cached response revalidated")
+		}
+		for k, v := range response.Header {
+			cached.Header[k] = v
+		}
+		t.store(filename, cached)
+		return cached, nil
+	}
+
+	if response.StatusCode != http.StatusOK || cacheControl(response.Header, "no-store") || !keyedVary(response.Header) {
+		return response, nil
+	}
+
+	t.store(filename, response)
+	return response, nil
+}
+
+// cacheKeyHeaders are the request headers which can change the response we
+// get back, and so which response is kept.  Accept-Encoding matters even when
+// the server doesn't say it varies on it: with -compressed we keep the body
+// as sent, and otherwise the transport decompresses it first.
+var cacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// cacheEntry returns the file in dir where the response to req is kept
+func cacheEntry(dir string, req *http.Request) string {
+	key := req.Method + " " + req.URL.String()
+	for _, h := range cacheKeyHeaders {
+		key += "\n" + h + ": " + strings.Join(req.Header.Values(h), ", ")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// keyedVary reports whether every request header the response varies on is
+// part of the cache key, so it can't be handed back for a different request
+func keyedVary(headers http.Header) bool {
+	for _, v := range headers.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(cacheKeyHeaders, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// store writes response to the cache.  Failing to is only worth a warning:
+// the response itself is fine.
+func (t *cachingTransport) store(filename string, response *http.Response) {
+	if err := writeCachedResponse(filename, response); err != nil {
+		log.Println("can't cache response:", err)
+	}
+}
+
+// readCachedResponse returns the response stored in filename for req, along
+// with when it was stored.
+func readCachedResponse(filename string, req *http.Request) (*http.Response, time.Time, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return response, fi.ModTime(), nil
+}
+
+// writeCachedResponse stores response in filename.  The response's body is
+// read in full and replaced, so it can still be read by the caller.
+func writeCachedResponse(filename string, response *http.Response) error {
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+
+	var buf bytes.Buffer
+	stored := *response
+	stored.Body = io.NopCloser(bytes.NewReader(body))
+	stored.TransferEncoding = nil
+	if err := stored.Write(&buf); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// cacheControl reports whether the Cache-Control header has the directive
+func cacheControl(headers http.Header, directive string) bool {
+	_, ok := cacheDirective(headers, directive)
+	return ok
+}
+
+// cacheDirective returns the value of a Cache-Control directive, and whether
+// it was present
+func cacheDirective(headers http.Header, directive string) (string, bool) {
+	for _, v := range headers.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(name, directive) {
+				return strings.Trim(value, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// cacheLifetime returns how long a response with headers stays fresh, from
+// Cache-Control's max-age or else Expires.  It is zero if the response has to
+// be revalidated each time.
+func cacheLifetime(headers http.Header) time.Duration {
+	if cacheControl(headers, "no-cache") || cacheControl(headers, "no-store") {
+		return 0
+	}
+	if v, ok := cacheDirective(headers, "max-age"); ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if v := headers.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(headers.Get("Date"))
+		if err != nil {
+			return time.Until(expires)
+		}
+		return expires.Sub(date)
+	}
+	return 0
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodeContentEncoding returns a reader decompressing r according to the
+// Content-Encoding header value encoding
+func decodeContentEncoding(encoding string, r io.Reader) (io.Reader, error) {
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+
+	return nil, fmt.Errorf("unable to decode Content-Encoding %q", encoding)
+}
+
+// loadCACerts returns a pool of the PEM certificates in files and in the
+// files anywhere under dirs.  Files in dirs that aren't PEM are skipped.
+func loadCACerts(files, dirs []string) (*x509.CertPool, error) {
+
+	pool := x509.NewCertPool()
+
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", f)
+		}
+	}
+
+	for _, dir := range dirs {
+		var found bool
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %v", err)
+		}
+		if !found {
+			return nil, fmt.Errorf("no PEM certificates under %s", dir)
+		}
+	}
+
+	return pool, nil
+}
+
+// connectTunnel asks the proxy for req's URL to open a tunnel to the URL's
+// host, and prints the proxy's response.  If pipe is set and the tunnel is
+// up, stdin and stdout are then copied through it.  It returns the status
+// code of the proxy's response.
+func connectTunnel(dialer *net.Dialer, req *http.Request, timeout time.Duration, tlsConfig *tls.Config, pipe bool, useColor bool) (int, error) {
+
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		if req.URL.Scheme == "https" {
+			target = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			target = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+
+	var proxyURL *url.URL
+	if proxy := http.DefaultTransport.(*http.Transport).Proxy; proxy != nil {
+		var err error
+		if proxyURL, err = proxy(req); err != nil {
+			return 0, fmt.Errorf("bad proxy: %v", err)
+		}
+	}
+	if proxyURL == nil {
+		return 0, errors.New("CONNECT needs a proxy: use -proxy or set HTTPS_PROXY")
+	}
+
+	addr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			addr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	if timeout != 0 {
+		d := *dialer
+		d.Timeout = timeout
+		dialer = &d
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		config := tlsConfig.Clone()
+		config.ServerName = proxyURL.Hostname()
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error connecting to proxy %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: req.Header.Clone(),
+	}
+	connect.Header.Del("Host")
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := connect.Write(conn); err != nil {
+		return 0, fmt.Errorf("error sending CONNECT: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	response, err := http.ReadResponse(br, connect)
+	if err != nil {
+		return 0, fmt.Errorf("error reading CONNECT response: %v", err)
+	}
+
+	if !pipe || response.StatusCode != http.StatusOK {
+		printResponseHeaders(useColor, response, false)
+		return response.StatusCode, nil
+	}
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+
+	// anything the proxy sent after its response is already in br
+	if _, err := io.Copy(stdout, br); err != nil {
+		return response.StatusCode, fmt.Errorf("error reading from tunnel: %v", err)
+	}
+
+	return response.StatusCode, nil
+}
+
+// http2SettingNames are the names of the settings from RFC 9113 section
+// 6.5.2, and the later registrations a server is likely to send
+var http2SettingNames = map[uint16]string{
+	1: "HEADER_TABLE_SIZE",
+	2: "ENABLE_PUSH",
+	3: "MAX_CONCURRENT_STREAMS",
+	4: "INITIAL_WINDOW_SIZE",
+	5: "MAX_FRAME_SIZE",
+	6: "MAX_HEADER_LIST_SIZE",
+	8: "ENABLE_CONNECT_PROTOCOL",
+	9: "NO_RFC7540_PRIORITIES",
+}
+
+// settingsConn is a connection to an HTTP/2 server which keeps the settings
+// from the server's first frame, which has to be SETTINGS.  The transport
+// in net/http keeps them to itself.
+type settingsConn struct {
+	*tls.Conn
+
+	mu       sync.Mutex
+	frame    []byte // the first frame, as much as has been read
+	done     bool
+	settings [][2]uint32
+	err      error
+}
+
+func (c *settingsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		c.frame = append(c.frame, p[:n]...)
+		// a 9 byte frame header, starting with a 24 bit length
+		if len(c.frame) >= 9 {
+			length := 9 + (int(c.frame[0])<<16 | int(c.frame[1])<<8 | int(c.frame[2]))
+			if len(c.frame) >= length {
+				c.settings, c.err = parseHTTP2Settings(c.frame[:length])
+				c.frame, c.done = nil, true
+			}
+		}
+	}
+
+	return n, err
+}
+
+// Settings returns the server's settings, in the order sent
+func (c *settingsConn) Settings() ([][2]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		return nil, errors.New("no SETTINGS from the server yet")
+	}
+	return c.settings, c.err
+}
+
+// parseHTTP2Settings returns the settings from a SETTINGS frame
+func parseHTTP2Settings(frame []byte) ([][2]uint32, error) {
+
+	// header: 24 bit length, type, flags and stream id
+	if frame[3] != 4 {
+		return nil, fmt.Errorf("server sent frame type %d, not SETTINGS", frame[3])
+	}
+
+	var settings [][2]uint32
+	for payload := frame[9:]; len(payload) >= 6; payload = payload[6:] {
+		settings = append(settings, [2]uint32{uint32(binary.BigEndian.Uint16(payload)), binary.BigEndian.Uint32(payload[2:])})
+	}
+
+	return settings, nil
+}
+
+// settingsTLSNextProto is the TLSNextProto for a transport whose HTTP/2
+// connections should keep the server's settings: x/net's HTTP/2 client, over
+// a settingsConn
+func settingsTLSNextProto(h2 *http2.Transport) map[string]func(string, *tls.Conn) http.RoundTripper {
+	return map[string]func(string, *tls.Conn) http.RoundTripper{
+		"h2": func(authority string, c *tls.Conn) http.RoundTripper {
+			conn := &settingsConn{Conn: c}
+			cc, err := h2.NewClientConn(conn)
+			if err != nil {
+				c.Close()
+				return http2ConnError{err}
+			}
+			return &http2Conn{ClientConn: cc, conn: conn}
+		},
+	}
+}
+
+// http2Conn sends requests over one HTTP/2 connection for the transport in
+// net/http
+type http2Conn struct {
+	*http2.ClientConn
+	conn *settingsConn
+	used atomic.Bool
+}
+
+// RoundTrip sends req, unless the connection is done with, when the transport
+// is told to dial a new one
+func (c *http2Conn) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.CanTakeNewRequest() {
+		return nil, noCachedConnError{}
+	}
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		// the transport in net/http leaves this to the HTTP/2 side
+		trace.GotConn(httptrace.GotConnInfo{Conn: c.conn, Reused: c.used.Swap(true)})
+	}
+	return c.ClientConn.RoundTrip(req)
+}
+
+// noCachedConnError is how the transport in net/http is told an HTTP/2
+// connection can't take another request
+type noCachedConnError struct{}
+
+func (noCachedConnError) IsHTTP2NoCachedConnError() {}
+
+func (noCachedConnError) Error() string { return "http2: no cached connection was available" }
+
+// http2ConnError is how the transport in net/http is told an HTTP/2
+// connection couldn't be set up, and has been closed
+type http2ConnError struct {
+	err error
+}
+
+func (e http2ConnError) RoundTripErr() error { return e.err }
+
+func (e http2ConnError) RoundTrip(*http.Request) (*http.Response, error) { return nil, e.err }
+
+// printHTTP2Settings prints a one line summary of the server's HTTP/2 settings
+func printHTTP2Settings(useColor bool, settings [][2]uint32) {
+
+	if useColor {
+		ct.ChangeColor(ct.Blue, false, ct.None, false)
+	}
+	fmt.Fprint(stdout, "HTTP/2 settings:")
+	if useColor {
+		ct.ResetColor()
+	}
+
+	for _, s := range settings {
+		name, ok := http2SettingNames[uint16(s[0])]
+		if !ok {
+			name = fmt.Sprintf("0x%x", s[0])
+		}
+		fmt.Fprint(stdout, " ")
+		if useColor {
+			ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		}
+		fmt.Fprint(stdout, name)
+		if useColor {
+			ct.ResetColor()
+		}
+		fmt.Fprint(stdout, "=")
+		if useColor {
+			ct.ChangeColor(ct.Yellow, false, ct.None, false)
+		}
+		fmt.Fprint(stdout, s[1])
+		if useColor {
+			ct.ResetColor()
+		}
+	}
+
+	fmt.Fprintln(stdout)
+}
+
+// dialAddr returns the host:port to connect to for u
+func dialAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// orderedTransport sends requests over HTTP/1.1 with the headers in order
+// first, in that order, and the rest after them.  The transport in net/http
+// always sorts them.  Each request gets a connection of its own.
+type orderedTransport struct {
+	order     []string
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig *tls.Config
+}
+
+// RoundTrip writes req out by hand on a new connection and reads the response
+// from it.
+func (t *orderedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	// like net/http, a body of unknown length is sent chunked
+	chunked := hasBody && req.ContentLength < 0
+
+	var body []byte
+	if hasBody && !chunked {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	headers := req.Header.Clone()
+	if headers.Get("Host") == "" {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		headers.Set("Host", host)
+	}
+	switch {
+	case chunked:
+		headers.Set("Transfer-Encoding", "chunked")
+	case hasBody:
+		headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	writeHeader := func(k string) {
+		for _, v := range headers[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+		delete(headers, k)
+	}
+	for _, k := range t.order {
+		writeHeader(http.CanonicalHeaderKey(k))
+	}
+	rest := make([]string, 0, len(headers))
+	for k := range headers {
+		rest = append(rest, k)
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		writeHeader(k)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	conn, err := t.dial(req.Context(), "tcp", dialAddr(req.URL))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		config := t.tlsConfig.Clone()
+		config.ServerName = req.URL.Hostname()
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if chunked {
+		w := httputil.NewChunkedWriter(conn)
+		_, err := io.Copy(w, req.Body)
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil {
+			_, err = io.WriteString(conn, "\r\n")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body = &connBody{ReadCloser: response.Body, conn: conn}
+	return response, nil
+}
+
+// connBody closes the connection along with the body it's read from
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+// Close closes the body and then the connection under it
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// sendRawRequest writes the contents of filename unmodified to the host named
+// by target, and copies the server's response bytes to stdout.  No attempt is
+// made to validate or normalize the request, which makes this useful for
+// poking at how servers handle malformed input.
+func sendRawRequest(dialer *net.Dialer, filename string, target string, timeout time.Duration, tlsConfig *tls.Config) error {
+
+	request, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read raw request: %v", err)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("bad url: %v", err)
+	}
+
+	addr := dialAddr(u)
+
+	if timeout != 0 {
+		d := *dialer
+		d.Timeout = timeout
+		dialer = &d
+	}
+
+	var conn net.Conn
+	if u.Scheme == "https" {
+		config := tlsConfig.Clone()
+		config.ServerName = u.Hostname()
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err = conn.Write(request); err != nil {
+		return fmt.Errorf("error writing request: %v", err)
+	}
+
+	// Parse the response only so we know where it ends; what we print is
+	// the bytes exactly as they came off the wire.  The method matters for
+	// HEAD, whose response has no body regardless of Content-Length.
+	method, _, _ := strings.Cut(string(request), " ")
+	var raw bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(conn, &raw))
+	response, err := http.ReadResponse(br, &http.Request{Method: method})
+	if err == nil {
+		_, err = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+
+	stdout.Write(raw.Bytes()[:raw.Len()-br.Buffered()])
+
+	if err != nil {
+		// not a response we understand; show whatever else the server sends
+		io.Copy(stdout, br)
+		return fmt.Errorf("error reading response: %v", err)
+	}
+
+	return nil
+}
+
+// jsonOptions controls how JSON documents are pretty-printed
+type jsonOptions struct {
+	color         bool
+	escapeUnicode bool // write non-ASCII runes as \uXXXX escapes
+	sortArrays    bool // sort arrays whose elements are all scalars of the same type
+	maxDepth      int  // if non-zero, collapse objects and arrays nested deeper than this
+	foldStrings   int  // if non-zero, truncate string values longer than this many runes
+
+	// how printJSONDocument shows a document
+	pointer   string // only show the value at this JSON pointer
+	flatten   bool   // as path = value lines
+	table     bool   // arrays of objects as a table
+	csv       bool   // arrays of objects as CSV
+	keys      bool   // only the keys
+	values    bool   // only the values
+	recursive bool   // keys or values of nested objects too
+}
+
+func (o *jsonOptions) changeColor(fg ct.Color, fgBright bool) {
+	if o.color {
+		ct.ChangeColor(fg, fgBright, ct.None, false)
+	}
+}
+
+func (o *jsonOptions) resetColor() {
+	if o.color {
+		ct.ResetColor()
+	}
+}
+
+// printJSONDocument prints the decoded JSON document j in the form selected
+// by opts
+func printJSONDocument(opts *jsonOptions, j interface{}) error {
+
+	if opts.pointer != "" {
+		var err error
+		if j, err = lookupJSONPointer(j, opts.pointer); err != nil {
+			return err
+		}
+
+		// bare strings are more useful for scripting unquoted
+		if s, ok := j.(string); ok {
+			fmt.Fprint(stdout, s)
+			return nil
+		}
+	}
+
+	if opts.flatten {
+		flattenJSON(opts, "", j)
+		return nil
+	}
+
+	if opts.csv {
+		if rows := jsonTable(j, true); rows != nil {
+			w := csv.NewWriter(stdout)
+			w.WriteAll(rows)
+			return w.Error()
+		}
+	}
+
+	if opts.table {
+		if rows := jsonTable(j, false); rows != nil {
+			printTable(opts.color, rows)
+			return nil
+		}
+	}
+
+	if opts.keys {
+		printJSONKeys(opts, "", j, opts.recursive)
+		return nil
+	}
+
+	if opts.values {
+		printJSONValues(opts, j, opts.recursive)
+		return nil
+	}
+
+	printJSON(opts, 1, j, false)
+	return nil
+}
+
+// printJSONBody decodes the JSON document in body and pretty-prints it to stdout
+func printJSONBody(opts *jsonOptions, body []byte) error {
+	j, err := decodeJSON(body)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling: %v", err)
+	}
+
+	printJSON(opts, 1, j, false)
+	return nil
+}
+
+// decodeJSON decodes body into a generic value, keeping numbers as json.Number
+// so they are printed exactly as the server sent them
+func decodeJSON(body []byte) (interface{}, error) {
+	var j interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// checkJSON returns an error giving the line and column of the first syntax
+// error in body, if there is one
+func checkJSON(body []byte) error {
+	var v interface{}
+	err := json.Unmarshal(body, &v)
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err
+	}
+	line := 1 + bytes.Count(body[:syntaxErr.Offset], []byte{'\n'})
+	col := int(syntaxErr.Offset) - bytes.LastIndexByte(body[:syntaxErr.Offset], '\n') - 1
+	return fmt.Errorf("line %d, column %d: %v", line, col, err)
+}
+
+// isJSON reports whether contentType is JSON, including vendor types such as
+// application/vnd.api+json
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json")
+}
+
+func isMsgpack(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/msgpack") || strings.HasPrefix(contentType, "application/x-msgpack")
+}
+
+// decodeMsgpack decodes a MessagePack document into the same kind of generic
+// value decodeJSON produces, so that it can be shown with the JSON formatter
+func decodeMsgpack(body []byte) (interface{}, error) {
+	d := msgpack.NewDecoder(bytes.NewReader(body))
+	// maps may have non-string keys
+	d.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+		return d.DecodeUntypedMap()
+	})
+	v, err := d.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	return msgpackToJSON(v), nil
+}
+
+func msgpackToJSON(val interface{}) interface{} {
+
+	switch v := val.(type) {
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return json.Number(fmt.Sprint(v))
+	case float32:
+		return json.Number(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case []byte:
+		// same as encoding/json
+		return base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = msgpackToJSON(e)
+		}
+		return v
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = msgpackToJSON(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = msgpackToJSON(e)
+		}
+		return m
+	}
+
+	return val
+}
+
+func isProtobuf(contentType string) bool {
+	for _, t := range []string{"application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf"} {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProtoMessage finds the message type name in the FileDescriptorSet stored
+// in filename, as produced by protoc --descriptor_set_out --include_imports
+func loadProtoMessage(filename string, name string) (protoreflect.MessageDescriptor, error) {
+
+	if name == "" {
+		return nil, errors.New("-proto-descriptor needs -proto-message")
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read proto descriptor: %v", err)
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("error parsing proto descriptor: %v", err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("error loading proto descriptor: %v", err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("proto message %q: %v", name, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a proto message", name)
+	}
+
+	return md, nil
+}
+
+// decodeProtobuf decodes body as a message of type md, returning the generic
+// value of its JSON form
+func decodeProtobuf(md protoreflect.MessageDescriptor, body []byte) (interface{}, error) {
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSON(b)
+}
+
+// printProtoRaw prints the fields in the protobuf message b by field number
+// and wire type, much like protoc --decode_raw.  Length-delimited fields are
+// shown as strings if they're printable, else as nested messages if they
+// parse as one, else in hex.
+func printProtoRaw(depth int, b []byte) error {
+
+	indent := strings.Repeat("    ", depth)
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		fmt.Fprintf(stdout, "%s%d: ", indent, num)
+
+		switch typ {
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			fmt.Fprintf(stdout, "%d\n", v)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			fmt.Fprintf(stdout, "0x%08x\n", v)
+		case protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			fmt.Fprintf(stdout, "0x%016x\n", v)
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n < 0 {
+				break
+			}
+			if utf8.Valid(v) && strings.IndexFunc(string(v), func(r rune) bool { return !unicode.IsPrint(r) && !unicode.IsSpace(r) }) == -1 {
+				fmt.Fprintln(stdout, quoteJSON(string(v), false))
+			} else if isProtoMessage(v) {
+				fmt.Fprintln(stdout, "{")
+				printProtoRaw(depth+1, v)
+				fmt.Fprintf(stdout, "%s}\n", indent)
+			} else {
+				fmt.Fprintf(stdout, "%x\n", v)
+			}
+		case protowire.StartGroupType:
+			var v []byte
+			v, n = protowire.ConsumeGroup(num, b)
+			if n < 0 {
+				break
+			}
+			fmt.Fprintln(stdout, "{")
+			printProtoRaw(depth+1, v)
+			fmt.Fprintf(stdout, "%s}\n", indent)
+		default:
+			return fmt.Errorf("unknown wire type %d", typ)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// isProtoMessage reports whether b parses as a sequence of protobuf fields
+func isProtoMessage(b []byte) bool {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// printGRPCWeb prints the messages and trailers in a gRPC-web response body.
+// Messages are decoded as md if it's known, else dumped field by field.
+func printGRPCWeb(opts *jsonOptions, md protoreflect.MessageDescriptor, contentType string, body []byte) error {
+
+	if strings.HasPrefix(contentType, "application/grpc-web-text") {
+		b, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return errors.New("short frame header")
+		}
+		flags, n := body[0], binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint32(len(body)) < n {
+			return errors.New("short frame")
+		}
+		frame := body[:n]
+		body = body[n:]
+
+		if flags&0x80 != 0 {
+			// trailers, in HTTP/1 header format
+			tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(frame), strings.NewReader("\r\n"))))
+			trailers, err := tp.ReadMIMEHeader()
+			if err != nil {
+				return fmt.Errorf("bad trailers: %v", err)
+			}
+			fmt.Fprintln(stdout)
+			printHeaders(opts.color, http.Header(trailers))
+			continue
+		}
+
+		if md == nil {
+			if err := printProtoRaw(0, frame); err != nil {
+				return err
+			}
+			continue
+		}
+
+		j, err := decodeProtobuf(md, frame)
+		if err != nil {
+			return err
+		}
+		printJSON(opts, 1, j, false)
+		fmt.Fprintln(stdout)
+	}
+
+	return nil
+}
+
+// lookupJSONPointer returns the value in doc referenced by the RFC 6901 JSON
+// Pointer ptr
+func lookupJSONPointer(doc interface{}, ptr string) (interface{}, error) {
+
+	if ptr == "" {
+		return doc, nil
+	}
+
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("bad json pointer %q: must start with '/'", ptr)
+	}
+
+	unescaper := strings.NewReplacer("~1", "/", "~0", "~")
+
+	v := doc
+	for _, tok := range strings.Split(ptr[1:], "/") {
+		tok = unescaper.Replace(tok)
+
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[tok]; !ok {
+				return nil, fmt.Errorf("json pointer %q: key %q not found", ptr, tok)
+			}
+
+		case []interface{}:
+			idx, err := strconv.Atoi(tok)
+			if err != nil || idx < 0 || (len(tok) > 1 && tok[0] == '0') {
+				return nil, fmt.Errorf("json pointer %q: bad array index %q", ptr, tok)
+			}
+			if idx >= len(vv) {
+				return nil, fmt.Errorf("json pointer %q: index %d out of range", ptr, idx)
+			}
+			v = vv[idx]
+
+		default:
+			return nil, fmt.Errorf("json pointer %q: cannot index into scalar with %q", ptr, tok)
+		}
+	}
+
+	return v, nil
+}
+
+// newDialer returns a dialer with the same settings as http.DefaultTransport's
+// but for the keep-alive interval and, if it's non-zero, the Happy Eyeballs
+// fallback delay.  Negative values disable either.
+func newDialer(keepAlive, fallbackDelay time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     keepAlive,
+		FallbackDelay: fallbackDelay,
+	}
+}
+
+// localIP returns the IP address s, or else the first address of the
+// network interface named s, preferring IPv4
+func localIP(s string) (net.IP, error) {
+
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+
+	ifi, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad -interface: %v", err)
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("bad -interface: %v", err)
+	}
+
+	var ip net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ip == nil {
+			ip = ipnet.IP
+		}
+	}
+
+	if ip == nil {
+		return nil, fmt.Errorf("bad -interface: %s has no addresses", s)
+	}
+
+	return ip, nil
+}
+
+// connectRule sends connections for host:port to toHost:toPort instead.  An
+// empty host or port matches anything, and an empty toHost or toPort keeps the
+// original.
+type connectRule struct {
+	host, port     string
+	toHost, toPort string
+}
+
+// parseConnectTo parses a -connect-to rule, host1:port1:host2:port2.  IPv6
+// addresses go in brackets.
+func parseConnectTo(s string) (connectRule, error) {
+	rule := s
+	var fields []string
+	for len(fields) < 3 {
+		if strings.HasPrefix(s, "[") {
+			i := strings.IndexByte(s, ']')
+			if i < 0 || !strings.HasPrefix(s[i+1:], ":") {
+				return connectRule{}, fmt.Errorf("bad -connect-to %q: unterminated IPv6 address", rule)
+			}
+			fields = append(fields, s[1:i])
+			s = s[i+2:]
+			continue
+		}
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			return connectRule{}, fmt.Errorf("bad -connect-to %q: want host1:port1:host2:port2", rule)
+		}
+		fields = append(fields, s[:i])
+		s = s[i+1:]
+	}
+	return connectRule{host: fields[0], port: fields[1], toHost: fields[2], toPort: s}, nil
+}
+
+// apply returns where to connect to in place of addr, and whether the rule
+// matched it
+func (r connectRule) apply(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	if (r.host != "" && !strings.EqualFold(r.host, host)) || (r.port != "" && r.port != port) {
+		return addr, false
+	}
+	if r.toHost != "" {
+		host = r.toHost
+	}
+	if r.toPort != "" {
+		port = r.toPort
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// connectAddr returns where to connect to for addr: the target of the first
+// rule matching it, else addr itself
+func connectAddr(rules []connectRule, addr string) string {
+	for _, r := range rules {
+		if to, ok := r.apply(addr); ok {
+			return to
+		}
+	}
+	return addr
+}
+
+// newResolver returns a resolver which sends DNS queries to servers rather than
+// those configured by the system.  Queries go to the first server until it
+// stops responding, after which we fail over to the next one.
+func newResolver(servers []string) *net.Resolver {
+
+	for i, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			servers[i] = net.JoinHostPort(s, "53")
+		}
+	}
+
+	var current uint32
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			var err error
+			for i := 0; i < len(servers); i++ {
+				idx := atomic.LoadUint32(&current)
+				server := servers[idx%uint32(len(servers))]
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, server); err == nil {
+					return &resolverConn{Conn: conn, failover: func() {
+						atomic.CompareAndSwapUint32(&current, idx, idx+1)
+					}}, nil
+				}
+				atomic.CompareAndSwapUint32(&current, idx, idx+1)
+			}
+			return nil, err
+		},
+	}
+}
+
+// resolverConn calls failover if talking to the DNS server fails
+type resolverConn struct {
+	net.Conn
+	failover func()
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && err != io.EOF {
+		c.failover()
+	}
+	return n, err
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.failover()
+	}
+	return n, err
+}
+
+func printJSON(opts *jsonOptions, depth int, val interface{}, isKey bool) {
+
+	switch v := val.(type) {
+	case nil:
+		opts.changeColor(ct.Blue, false)
+		fmt.Fprint(stdout, "null")
+		opts.resetColor()
+	case bool:
+		opts.changeColor(ct.Blue, false)
+		if v {
+			fmt.Fprint(stdout, "true")
+		} else {
+			fmt.Fprint(stdout, "false")
+		}
+		opts.resetColor()
+	case string:
+		if isKey {
+			opts.changeColor(ct.Blue, true)
+		} else {
+			opts.changeColor(ct.Yellow, false)
+		}
+		if n := utf8.RuneCountInString(v); !isKey && opts.foldStrings > 0 && n > opts.foldStrings {
+			fmt.Fprint(stdout, quoteJSON(string([]rune(v)[:opts.foldStrings])+"…", opts.escapeUnicode))
+			opts.resetColor()
+			fmt.Fprintf(stdout, " (%d chars)", n)
+			break
+		}
+		fmt.Fprint(stdout, quoteJSON(v, opts.escapeUnicode))
+		opts.resetColor()
+	case json.Number:
+		opts.changeColor(ct.Blue, false)
+		fmt.Fprint(stdout, v)
+		opts.resetColor()
+	case map[string]interface{}:
+
+		if len(v) == 0 {
+			fmt.Fprint(stdout, "{}")
+			break
+		}
+
+		if opts.maxDepth > 0 && depth > opts.maxDepth {
+			fmt.Fprintf(stdout, "{… %d keys}", len(v))
+			break
+		}
+
+		var keys []string
+
+		for h := range v {
+			keys = append(keys, h)
+		}
+
+		sort.Strings(keys)
+
+		fmt.Fprintln(stdout, "{")
+		needNL := false
+		for _, key := range keys {
+			if needNL {
+				fmt.Fprint(stdout, ",\n")
+			}
+			needNL = true
+			for i := 0; i < depth; i++ {
+				fmt.Fprint(stdout, "    ")
+			}
+
+			printJSON(opts, depth+1, key, true)
+			fmt.Fprint(stdout, ": ")
+			printJSON(opts, depth+1, v[key], false)
+		}
+		fmt.Fprintln(stdout, "")
+
+		for i := 0; i < depth-1; i++ {
+			fmt.Fprint(stdout, "    ")
+		}
+		fmt.Fprint(stdout, "}")
+
+	case []interface{}:
+
+		if len(v) == 0 {
+			fmt.Fprint(stdout, "[]")
+			break
+		}
+
+		if opts.maxDepth > 0 && depth > opts.maxDepth {
+			fmt.Fprintf(stdout, "[… %d items]", len(v))
+			break
+		}
+
+		if opts.sortArrays {
+			v = sortedScalars(v)
+		}
+
+		fmt.Fprintln(stdout, "[")
+		needNL := false
+		for _, e := range v {
+			if needNL {
+				fmt.Fprint(stdout, ",\n")
+			}
+			needNL = true
+			for i := 0; i < depth; i++ {
+				fmt.Fprint(stdout, "    ")
+			}
+
+			printJSON(opts, depth+1, e, false)
+		}
+		fmt.Fprintln(stdout, "")
+
+		for i := 0; i < depth-1; i++ {
+			fmt.Fprint(stdout, "    ")
+		}
+		fmt.Fprint(stdout, "]")
+	default:
+		fmt.Fprintln(stdout, "unknown type:", reflect.TypeOf(v))
+	}
+}
+
+// flattenJSON prints val as one "path = value" line per leaf, which is much
+// easier to grep than the indented form
+func flattenJSON(opts *jsonOptions, path string, val interface{}) {
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			printFlatLine(opts, path, v)
+			return
+		}
+
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			flattenJSON(opts, flatKeyPath(path, k), v[k])
+		}
+
+	case []interface{}:
+		if len(v) == 0 {
+			printFlatLine(opts, path, v)
+			return
+		}
+
+		if opts.sortArrays {
+			v = sortedScalars(v)
+		}
+
+		for i, e := range v {
+			flattenJSON(opts, path+"["+strconv.Itoa(i)+"]", e)
+		}
+
+	default:
+		printFlatLine(opts, path, v)
+	}
+}
+
+// flatKeyPath appends key to path, using the bracketed form if key isn't a
+// simple identifier
+func flatKeyPath(path, key string) string {
+
+	simple := key != ""
+	for i, r := range key {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			simple = false
+			break
+		}
+	}
+
+	if !simple {
+		return path + "[" + quoteJSON(key, false) + "]"
+	}
+
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func printFlatLine(opts *jsonOptions, path string, val interface{}) {
+
+	if path == "" {
+		path = "."
+	}
+
+	opts.changeColor(ct.Cyan, false)
+	fmt.Fprint(stdout, path)
+	opts.resetColor()
+	fmt.Fprint(stdout, " = ")
+	printJSON(opts, 1, val, false)
+	fmt.Fprintln(stdout)
+}
+
+// printJSONKeys prints the keys of the object val one per line, or the
+// indices if val is an array.  If recursive is set, the paths of all nested
+// keys are printed too.
+func printJSONKeys(opts *jsonOptions, path string, val interface{}, recursive bool) {
+
+	var keys []string
+	var vals []interface{}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			vals = append(vals, v[k])
+			keys[i] = flatKeyPath(path, k)
+		}
+
+	case []interface{}:
+		for i, e := range v {
+			keys = append(keys, path+"["+strconv.Itoa(i)+"]")
+			vals = append(vals, e)
+		}
+	}
+
+	for i, k := range keys {
+		opts.changeColor(ct.Blue, true)
+		fmt.Fprintln(stdout, k)
+		opts.resetColor()
+		if recursive {
+			printJSONKeys(opts, k, vals[i], true)
+		}
+	}
+}
+
+// printJSONValues prints the members of the object or array val one per line.
+// Strings are printed unquoted and nested objects and arrays as compact JSON.
+// If recursive is set, nested values are descended into and only leaves are
+// printed.
+func printJSONValues(opts *jsonOptions, val interface{}, recursive bool) {
+
+	var vals []interface{}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			vals = append(vals, v[k])
+		}
+
+	case []interface{}:
+		vals = v
+
+	default:
+		vals = []interface{}{v}
+	}
+
+	for _, e := range vals {
+		switch ev := e.(type) {
+		case map[string]interface{}, []interface{}:
+			if recursive {
+				printJSONValues(opts, ev, true)
+				continue
+			}
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.Encode(ev)
+			stdout.Write(buf.Bytes())
+
+		case string:
+			opts.changeColor(ct.Yellow, false)
+			fmt.Fprint(stdout, ev)
+			opts.resetColor()
+			fmt.Fprintln(stdout)
+
+		default:
+			printJSON(opts, 1, ev, false)
+			fmt.Fprintln(stdout)
+		}
+	}
+}
+
+// printExports prints an "export VAR='value'" line for each VAR=/json/pointer
+// in exports, with the value looked up in the JSON document body
+func printExports(body []byte, exports []string) error {
+
+	j, err := decodeJSON(body)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling response body: %v", err)
+	}
+
+	for _, e := range exports {
+		name, ptr, ok := strings.Cut(e, "=")
+		if !ok || !isShellName(name) {
+			return fmt.Errorf("bad export %q: want VAR=/json/pointer", e)
+		}
+
+		v, err := lookupJSONPointer(j, ptr)
+		if err != nil {
+			return err
+		}
+
+		var val string
+		switch vv := v.(type) {
+		case nil:
+			val = ""
+		case string:
+			val = vv
+		case json.Number:
+			val = vv.String()
+		case bool:
+			val = strconv.FormatBool(vv)
+		default:
+			b, err := json.Marshal(vv)
+			if err != nil {
+				return err
+			}
+			val = string(b)
+		}
+
+		fmt.Fprintf(stdout, "export %s=%s\n", name, shellQuote(val))
+	}
+
+	return nil
+}
+
+func isShellName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellArg quotes s for a POSIX shell, if it needs it
+func shellArg(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// httpieCommand returns the HTTPie command line which sends the same request
+// as the given method, URL and request items.  An empty method is left for
+// HTTPie to choose.  Files are uploaded as a form if multipart is set, else
+// embedded in the JSON body.
+func httpieCommand(method string, u string, kvp *kvpairs, form, multipart bool, bodyFile string, auth string) string {
+
+	uploads := len(kvp.file)
+	if _, ok := kvp.file["-"]; ok {
+		uploads--
+	}
+	form = form || multipart && uploads > 0
+
+	args := []string{"http"}
+	if form {
+		args = append(args, "--form")
+	}
+	if auth != "" {
+		args = append(args, "--auth", auth)
+	}
+	if method != "" {
+		args = append(args, method)
+	}
+	args = append(args, u)
+
+	sortedKeys := func(m map[string][]string) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	headers := make(map[string][]string, len(kvp.headers))
+	for k, v := range kvp.headers {
+		headers[k] = []string{v}
+	}
+	for _, k := range sortedKeys(headers) {
+		args = append(args, k+":"+headers[k][0])
+	}
+	for _, k := range sortedKeys(kvp.query) {
+		for _, v := range kvp.query[k] {
+			args = append(args, k+"=="+v)
+		}
+	}
+	for _, k := range sortedKeys(kvp.body) {
+		for _, v := range kvp.body[k] {
+			args = append(args, k+"="+v)
+		}
+	}
+	js := make(map[string][]string, len(kvp.js))
+	for k, v := range kvp.js {
+		js[k] = []string{v}
+	}
+	for _, k := range sortedKeys(js) {
+		args = append(args, k+":="+js[k][0])
+	}
+	for _, k := range sortedKeys(kvp.file) {
+		for _, v := range kvp.file[k] {
+			switch {
+			case k == "-":
+				bodyFile = v
+			case form:
+				args = append(args, k+"@"+v)
+			default:
+				args = append(args, k+"=@"+v)
+			}
+		}
+	}
+
+	for i, a := range args {
+		args[i] = shellArg(a)
+	}
+	if bodyFile != "" {
+		args = append(args, "<", shellArg(bodyFile))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// shellQuote single-quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sortedScalars returns a sorted copy of arr if every element is a string, every
+// element is a number, or every element is a bool.  Any other array is returned
+// unchanged.
+func sortedScalars(arr []interface{}) []interface{} {
+
+	var less func(a, b interface{}) bool
+
+	switch arr[0].(type) {
+	case string:
+		less = func(a, b interface{}) bool { return a.(string) < b.(string) }
+	case json.Number:
+		less = func(a, b interface{}) bool {
+			fa, erra := a.(json.Number).Float64()
+			fb, errb := b.(json.Number).Float64()
+			if erra != nil || errb != nil {
+				return a.(json.Number) < b.(json.Number)
+			}
+			return fa < fb
+		}
+	case bool:
+		less = func(a, b interface{}) bool { return !a.(bool) && b.(bool) }
+	default:
+		return arr
+	}
+
+	t := reflect.TypeOf(arr[0])
+	for _, e := range arr[1:] {
+		if reflect.TypeOf(e) != t {
+			return arr
+		}
+	}
+
+	sorted := make([]interface{}, len(arr))
+	copy(sorted, arr)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+
+	return sorted
+}
+
+// quoteJSON returns s as a quoted JSON string.  Unlike strconv.Quote, the
+// escapes produced are always valid JSON.  Non-ASCII runes are left as UTF-8
+// unless escapeUnicode is set.
+func quoteJSON(s string, escapeUnicode bool) string {
+
+	const hex = "0123456789abcdef"
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			b = append(b, '\\', '"')
+		case r == '\\':
+			b = append(b, '\\', '\\')
+		case r == '\n':
+			b = append(b, '\\', 'n')
+		case r == '\r':
+			b = append(b, '\\', 'r')
+		case r == '\t':
+			b = append(b, '\\', 't')
+		case r < 0x20, r == '\u2028', r == '\u2029', escapeUnicode && r >= utf8.RuneSelf:
+			// invalid utf-8 has already been turned into U+FFFD by the range loop
+			r1, r2 := utf16.EncodeRune(r)
+			if r1 == unicode.ReplacementChar {
+				r1 = r
+			} else {
+				b = append(b, '\\', 'u', hex[r1>>12&0xf], hex[r1>>8&0xf], hex[r1>>4&0xf], hex[r1&0xf])
+				r1 = r2
+			}
+			b = append(b, '\\', 'u', hex[r1>>12&0xf], hex[r1>>8&0xf], hex[r1>>4&0xf], hex[r1&0xf])
+		default:
+			b = utf8.AppendRune(b, r)
+		}
+	}
+
+	b = append(b, '"')
+	return string(b)
+}
+
+// jsonTable converts an array of objects into rows for printTable, with a
+// header row made of the union of the objects' keys.  Nested values are
+// abbreviated, or if full is set, written out as JSON with null left empty.
+// It returns nil if val isn't an array of objects.
+func jsonTable(val interface{}, full bool) [][]string {
+
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil
+	}
+
+	keyset := make(map[string]bool)
+	for _, e := range arr {
+		obj, ok := e.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for k := range obj {
+			keyset[k] = true
+		}
+	}
+
+	var keys []string
+	for k := range keyset {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rows := [][]string{keys}
+
+	for _, e := range arr {
+		obj := e.(map[string]interface{})
+		row := make([]string, len(keys))
+		for i, k := range keys {
+			v, ok := obj[k]
+			if !ok {
+				continue
+			}
+			if full {
+				switch v.(type) {
+				case nil:
+					continue
+				case map[string]interface{}, []interface{}:
+					b, _ := json.Marshal(v)
+					row[i] = string(b)
+					continue
+				}
+			}
+			switch vv := v.(type) {
+			case nil:
+				row[i] = "null"
+			case bool:
+				row[i] = strconv.FormatBool(vv)
+			case string:
+				row[i] = vv
+			case json.Number:
+				row[i] = vv.String()
+			case map[string]interface{}:
+				row[i] = "{…}"
+			case []interface{}:
+				row[i] = "[…]"
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// htmlSummary returns the title and meta description of the HTML document
+// body, if it has them
+func htmlSummary(body []byte) (title, description string) {
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return "", ""
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Title:
+				if title == "" && n.FirstChild != nil {
+					title = strings.Join(strings.Fields(n.FirstChild.Data), " ")
+				}
+			case atom.Meta:
+				var name, content string
+				for _, a := range n.Attr {
+					switch a.Key {
+					case "name":
+						name = a.Val
+					case "content":
+						content = a.Val
+					}
+				}
+				if description == "" && strings.EqualFold(name, "description") {
+					description = strings.TrimSpace(content)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return title, description
+}
+
+// metaRefresh returns the URL an HTML response redirects to with a
+// <meta http-equiv="refresh">, or nil if it doesn't
+func metaRefresh(response *http.Response, body []byte) *url.URL {
+
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	var content string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Meta && content == "" {
+			var refresh bool
+			var c string
+			for _, a := range n.Attr {
+				switch a.Key {
+				case "http-equiv":
+					refresh = strings.EqualFold(a.Val, "refresh")
+				case "content":
+					c = a.Val
+				}
+			}
+			if refresh {
+				content = c
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	// content is the delay, then optionally "; url=target"
+	_, target, ok := strings.Cut(content, ";")
+	if !ok {
+		// just reloads this page
+		return nil
+	}
+	target = strings.TrimSpace(target)
+	if len(target) < 4 || !strings.EqualFold(target[:4], "url=") {
+		return nil
+	}
+	target = strings.Trim(strings.TrimSpace(target[4:]), `'"`)
+
+	u, err := response.Request.URL.Parse(target)
+	if err != nil {
+		return nil
+	}
+
+	return u
+}
+
+var (
+	markdownHeading = regexp.MustCompile(`^#{1,6}\s`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+	markdownCode    = regexp.MustCompile("`[^`]+`")
+)
+
+// printMarkdown prints the markdown document body with some terminal
+// styling: headings bold, code dimmed and link text underlined
+func printMarkdown(body []byte) {
+
+	const (
+		bold, dim, underline = "\x1b[1m", "\x1b[2m", "\x1b[4m"
+		reset                = "\x1b[0m"
+	)
+
+	inCode := false
+	for _, line := range strings.SplitAfter(string(body), "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		nl := line[len(text):]
+
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(text), "```"):
+			inCode = !inCode
+			fmt.Fprint(stdout, dim, text, reset, nl)
+		case inCode:
+			fmt.Fprint(stdout, dim, text, reset, nl)
+		case markdownHeading.MatchString(text):
+			fmt.Fprint(stdout, bold, text, reset, nl)
+		default:
+			// links first, as the escape codes look like the start of one
+			text = markdownLink.ReplaceAllString(text, underline+"$1"+reset+" ("+dim+"$2"+reset+")")
+			text = markdownCode.ReplaceAllString(text, dim+"$0"+reset)
+			fmt.Fprint(stdout, text, nl)
+		}
+	}
+}
+
+// jarCookie is a cookie as kept in a Netscape format cookie file
+type jarCookie struct {
+	domain   string // without any leading '.'
+	hostOnly bool   // only for domain itself, not its subdomains
+	path     string
+	secure   bool
+	httpOnly bool
+	expires  time.Time // zero for a session cookie
+	name     string
+	value    string
+}
+
+// netscapeJar is an http.CookieJar which reads and writes the Netscape cookie
+// file format used by curl and wget
+type netscapeJar struct {
+	mu      sync.Mutex
+	cookies []jarCookie
+}
+
+func (j *netscapeJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	for _, c := range cookies {
+		jc := jarCookie{
+			domain:   host,
+			hostOnly: true,
+			path:     c.Path,
+			secure:   c.Secure,
+			httpOnly: c.HttpOnly,
+			expires:  c.Expires,
+			name:     c.Name,
+			value:    c.Value,
+		}
+
+		if c.Domain != "" {
+			jc.domain = strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+			jc.hostOnly = false
+			if !domainMatch(host, jc.domain) {
+				continue
+			}
+		}
+
+		if !strings.HasPrefix(jc.path, "/") {
+			// the directory of the request path
+			jc.path = "/"
+			if i := strings.LastIndexByte(u.Path, '/'); i > 0 {
+				jc.path = u.Path[:i]
+			}
+		}
+
+		switch {
+		case c.MaxAge < 0:
+			jc.expires = now
+		case c.MaxAge > 0:
+			jc.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+
+		// replace any cookie with the same name, domain and path
+		found := false
+		for i, old := range j.cookies {
+			if old.name == jc.name && old.domain == jc.domain && old.path == jc.path {
+				j.cookies[i], found = jc, true
+				break
 			}
 		}
+		if !found {
+			j.cookies = append(j.cookies, jc)
+		}
+	}
+}
+
+func (j *netscapeJar) Cookies(u *url.URL) []*http.Cookie {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	var cookies []*http.Cookie
+	for _, c := range j.cookies {
+		if !c.expires.IsZero() && !c.expires.After(now) {
+			continue
+		}
+		if c.hostOnly && host != c.domain || !c.hostOnly && !domainMatch(host, c.domain) {
+			continue
+		}
+		if !pathMatch(u.Path, c.path) || c.secure && u.Scheme != "https" {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: c.name, Value: c.value})
+	}
+
+	return cookies
+}
+
+// domainMatch reports whether a cookie for domain should be sent to host
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatch reports whether a cookie for cookiePath should be sent for a
+// request to path
+func pathMatch(path, cookiePath string) bool {
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return len(path) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// load adds the cookies in the Netscape format cookie file filename.  A file
+// which doesn't exist yet is fine.
+func (j *netscapeJar) load(filename string) error {
+
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read cookie file: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for lineno, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		}
+		if strings.TrimSpace(line) == "" || line[0] == '#' {
+			continue
+		}
 
-		// construct the extra body parameters
-		values := url.Values{}
-		for k, v := range bodyparams {
-			addValues(values, k, v)
+		f := strings.Split(line, "\t")
+		if len(f) != 7 {
+			return fmt.Errorf("%s:%d: bad cookie line", filename, lineno+1)
 		}
 
-		// and write them into the body
-		for k, v := range values {
-			for _, vv := range v {
-				writer.WriteField(k, vv)
-			}
+		expiry, err := strconv.ParseInt(f[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad cookie expiry: %v", filename, lineno+1, err)
 		}
 
-		writer.Close()
+		c := jarCookie{
+			domain:   strings.ToLower(strings.TrimPrefix(f[0], ".")),
+			hostOnly: f[1] != "TRUE",
+			path:     f[2],
+			secure:   f[3] == "TRUE",
+			httpOnly: httpOnly,
+			name:     f[5],
+			value:    f[6],
+		}
+		if expiry != 0 {
+			c.expires = time.Unix(expiry, 0)
+		}
+		j.cookies = append(j.cookies, c)
+	}
 
-		body = buf.Bytes()
-		req.Header.Add("Content-Type", writer.FormDataContentType())
+	return nil
+}
 
-	} else if len(bodyparams) > 0 || len(kvp.file) > 0 {
+// save writes the unexpired cookies to filename in Netscape format
+func (j *netscapeJar) save(filename string) error {
 
-		// add our files as body values
-		for k, v := range kvp.file {
-			var file *os.File
-			if file, err = os.Open(v); err != nil {
-				log.Fatal("unable to open file for body: ", err)
-			}
-			defer file.Close()
+	j.mu.Lock()
+	defer j.mu.Unlock()
 
-			var val []byte
-			if val, err = io.ReadAll(file); err != nil {
-				log.Fatal("error reading body contents: ", err)
-			}
-			// string so that we get file contents and not base64 encoded contents
-			bodyparams[k] = string(val)
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n")
+
+	now := time.Now()
+	bools := map[bool]string{true: "TRUE", false: "FALSE"}
+
+	for _, c := range j.cookies {
+		if !c.expires.IsZero() && !c.expires.After(now) {
+			continue
 		}
 
-		if *postform {
-			values := url.Values{}
-			for k, v := range bodyparams {
-				addValues(values, k, v)
-			}
-			body = []byte(values.Encode())
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		} else {
-			body, err = json.Marshal(bodyparams)
-			if err != nil {
-				log.Fatal("error marshalling request body params:", err)
-			}
-			req.Header.Set("Content-Type", "application/json")
+		domain := c.domain
+		if !c.hostOnly {
+			domain = "." + domain
+		}
+		if c.httpOnly {
+			domain = "#HttpOnly_" + domain
 		}
-	}
 
-	if body != nil {
-		req.Body = io.NopCloser(bytes.NewReader(body))
-		req.ContentLength = int64(len(body))
-		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
-		if !methodProvided {
-			req.Method = "POST"
+		var expiry int64
+		if !c.expires.IsZero() {
+			expiry = c.expires.Unix()
 		}
-	}
 
-	defaultHeaders := map[string]string{
-		"User-Agent": "gttp http for gophers",
-		"Accept":     "*/*",
-		"Host":       req.URL.Host,
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, bools[!c.hostOnly], c.path, bools[c.secure], expiry, c.name, c.value)
 	}
 
-	for k, v := range defaultHeaders {
-		req.Header.Set(k, v)
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to write cookie jar: %v", err)
 	}
 
-	for k, v := range kvp.headers {
-		req.Header.Set(k, v)
-	}
+	return nil
+}
+
+// cookieTable lays out cookies as rows for printTable
+func cookieTable(cookies []*http.Cookie) [][]string {
+
+	rows := [][]string{{"name", "value", "domain", "path", "expires", "flags"}}
 
-	if *verbose {
-		printRequestHeaders(*color, req)
-		os.Stdout.Write(body)
-		os.Stdout.Write([]byte{'\n', '\n'})
+	for _, c := range cookies {
+		rows = append(rows, []string{c.Name, c.Value, c.Domain, c.Path, cookieExpiry(c), strings.Join(cookieFlags(c), " ")})
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	return rows
+}
 
-	if err != nil {
-		log.Fatal("error during fetch:", err)
+// cookieExpiry describes when c expires
+func cookieExpiry(c *http.Cookie) string {
+	switch {
+	case c.MaxAge < 0:
+		return "now"
+	case c.MaxAge > 0:
+		return (time.Duration(c.MaxAge) * time.Second).String()
+	case !c.Expires.IsZero():
+		return c.Expires.Format(time.RFC3339)
 	}
+	return "session"
+}
+
+// cookieFlags returns the Secure, HttpOnly and SameSite attributes of c
+func cookieFlags(c *http.Cookie) []string {
 
-	if !*onlyBody {
-		printResponseHeaders(*color, response)
+	var flags []string
+	if c.Secure {
+		flags = append(flags, "Secure")
+	}
+	if c.HttpOnly {
+		flags = append(flags, "HttpOnly")
+	}
+	switch c.SameSite {
+	case http.SameSiteLaxMode:
+		flags = append(flags, "SameSite=Lax")
+	case http.SameSiteStrictMode:
+		flags = append(flags, "SameSite=Strict")
+	case http.SameSiteNoneMode:
+		flags = append(flags, "SameSite=None")
 	}
 
-	if !*onlyHeaders {
-		body, err = io.ReadAll(response.Body)
-		if err != nil {
-			log.Fatal("error reading response body:", err)
+	return flags
+}
+
+// printTable prints rows as aligned columns, treating the first row as a header
+func printTable(useColor bool, rows [][]string) {
+
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			w := runewidth.StringWidth(cell)
+			if i >= len(widths) {
+				widths = append(widths, w)
+			} else if w > widths[i] {
+				widths[i] = w
+			}
 		}
-		response.Body.Close()
+	}
 
-		if *rawOutput {
-			os.Stdout.Write(body)
-		} else if *noFormatting {
+	colors := []ct.Color{ct.Cyan, ct.Yellow}
 
-			if bytes.IndexByte(body, 0) != -1 {
-				os.Stdout.WriteString(msgNoBinaryToTerminal)
-			} else {
-				os.Stdout.Write(body)
+	for r, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(stdout, "  ")
+			}
+			if useColor {
+				ct.ChangeColor(colors[i%len(colors)], r == 0, ct.None, false)
+			}
+			fmt.Fprint(stdout, cell)
+			if useColor {
+				ct.ResetColor()
 			}
+			if i < len(row)-1 {
+				fmt.Fprint(stdout, strings.Repeat(" ", widths[i]-runewidth.StringWidth(cell)))
+			}
+		}
+		fmt.Fprintln(stdout)
+	}
+}
+
+func printRequestHeaders(useColor bool, request *http.Request) {
+
+	u := request.URL.Path
+	if u == "" {
+		u = "/"
+	}
+
+	if request.URL.RawQuery != "" {
+		u += "?" + request.URL.RawQuery
+	}
+
+	if useColor {
+		ct.ChangeColor(ct.Green, false, ct.None, false)
+		fmt.Fprintf(stdout, "%s", request.Method)
+		ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		fmt.Fprintf(stdout, " %s", u)
+		ct.ChangeColor(ct.Blue, false, ct.None, false)
+		fmt.Fprintf(stdout, " %s", request.Proto)
+	} else {
+		fmt.Fprintf(stdout, "%s %s %s", request.Method, u, request.Proto)
+	}
 
+	// the transport adds the length headers, so show what it will send
+	headers := request.Header
+	if request.Body != nil {
+		headers = headers.Clone()
+		if request.ContentLength >= 0 {
+			headers.Set("Content-Length", strconv.FormatInt(request.ContentLength, 10))
 		} else {
+			headers.Set("Transfer-Encoding", "chunked")
+		}
+	}
 
-			// maybe do some formatting
+	fmt.Fprintln(stdout)
+	printHeaders(useColor, headers)
+	fmt.Fprintln(stdout)
+}
 
-			switch {
+func printResponseHeaders(useColor bool, response *http.Response, cookies bool) {
 
-			case strings.HasPrefix(response.Header.Get("Content-type"), "application/json"):
-				var j interface{}
-				d := json.NewDecoder(bytes.NewReader(body))
-				d.UseNumber()
-				if err := d.Decode(&j); err != nil {
-					log.Fatal("error unmarshalling response body:", err)
-				}
-				if *color {
-					printJSON(1, j, false)
-				} else {
-					body, err = json.MarshalIndent(j, "", "    ")
-					if err != nil {
-						log.Fatal("error re-marshalling response body:", err)
-					}
+	// Status should be the code and reason, but a response we didn't read
+	// off the wire ourselves may have anything there
+	code := strconv.Itoa(response.StatusCode)
+	var reason string
+	if r := strings.TrimSpace(strings.TrimPrefix(response.Status, code)); r != "" {
+		reason = " " + r
+	}
 
-					os.Stdout.Write(body)
-				}
+	if useColor {
+		ct.ChangeColor(ct.Blue, false, ct.None, false)
+		fmt.Fprintf(stdout, "%s %s", response.Proto, code)
+		ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		fmt.Fprintf(stdout, "%s", reason)
+	} else {
+		fmt.Fprintf(stdout, "%s %s%s", response.Proto, code, reason)
+	}
 
-			case strings.HasPrefix(response.Header.Get("Content-type"), "text/"):
-				os.Stdout.Write(body)
+	fmt.Fprintln(stdout)
+	if cookies {
+		headers := response.Header.Clone()
+		headers.Del("Set-Cookie")
+		printHeaders(useColor, headers)
+		printCookies(useColor, response.Cookies())
+	} else {
+		printHeaders(useColor, response.Header)
+	}
+	fmt.Fprintln(stdout)
+}
 
-			case bytes.IndexByte(body, 0) != -1:
-				// at least one 0 byte, assume it's binary data :/
-				// silly, but it's the same heuristic as httpie
-				os.Stdout.WriteString(msgNoBinaryToTerminal)
+// hypermediaLink is a link found in the body of a JSON response
+type hypermediaLink struct {
+	rel  string
+	href string
+}
 
-			default:
-				os.Stdout.Write(body)
-			}
+// jsonLinks returns the links in a HAL (_links) or JSON:API (links) document,
+// sorted by relation.  HAL relations may hold an array of links.
+func jsonLinks(j interface{}) []hypermediaLink {
+	obj, ok := j.(map[string]interface{})
+	if !ok {
+		return nil
+	}
 
-			// formatted output ends with two newlines
-			os.Stdout.Write([]byte{'\n', '\n'})
+	var links []hypermediaLink
+	var add func(rel string, v interface{})
+	add = func(rel string, v interface{}) {
+		switch v := v.(type) {
+		case string:
+			links = append(links, hypermediaLink{rel, v})
+		case map[string]interface{}:
+			if href, ok := v["href"].(string); ok {
+				links = append(links, hypermediaLink{rel, href})
+			}
+		case []interface{}:
+			for _, l := range v {
+				add(rel, l)
+			}
 		}
 	}
 
-	if response.StatusCode >= 400 {
-		os.Exit(response.StatusCode - 399)
+	for _, key := range []string{"_links", "links"} {
+		rels, ok := obj[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for rel, v := range rels {
+			add(rel, v)
+		}
 	}
+
+	sort.SliceStable(links, func(i, j int) bool { return links[i].rel < links[j].rel })
+	return links
 }
 
-func printJSON(depth int, val interface{}, isKey bool) {
+// printLinks prints a line for each link, after a blank line to separate
+// them from the body
+func printLinks(useColor bool, links []hypermediaLink) {
 
-	switch v := val.(type) {
-	case nil:
-		ct.ChangeColor(ct.Blue, false, ct.None, false)
-		fmt.Print("null")
-		ct.ResetColor()
-	case bool:
-		ct.ChangeColor(ct.Blue, false, ct.None, false)
-		if v {
-			fmt.Print("true")
-		} else {
-			fmt.Print("false")
-		}
-		ct.ResetColor()
-	case string:
-		if isKey {
-			ct.ChangeColor(ct.Blue, true, ct.None, false)
-		} else {
-			ct.ChangeColor(ct.Yellow, false, ct.None, false)
+	if len(links) == 0 {
+		return
+	}
+
+	fmt.Fprintln(stdout)
+	for _, l := range links {
+		if !useColor {
+			fmt.Fprintf(stdout, "\n%s: %s", l.rel, l.href)
+			continue
 		}
-		fmt.Print(strconv.Quote(v))
+		fmt.Fprintln(stdout)
+		ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		fmt.Fprint(stdout, l.rel)
 		ct.ResetColor()
-	case json.Number:
+		fmt.Fprint(stdout, ": ")
 		ct.ChangeColor(ct.Blue, false, ct.None, false)
-		fmt.Print(v)
+		fmt.Fprint(stdout, l.href)
 		ct.ResetColor()
-	case map[string]interface{}:
+	}
+}
 
-		if len(v) == 0 {
-			fmt.Print("{}")
-			break
-		}
+// printCookies prints a line for each cookie, decoded, in place of the raw
+// Set-Cookie headers
+func printCookies(useColor bool, cookies []*http.Cookie) {
 
-		var keys []string
+	for _, c := range cookies {
+		var attrs []string
+		if c.Domain != "" {
+			attrs = append(attrs, "domain="+c.Domain)
+		}
+		if c.Path != "" {
+			attrs = append(attrs, "path="+c.Path)
+		}
+		attrs = append(attrs, "expires="+cookieExpiry(c))
+		attrs = append(attrs, cookieFlags(c)...)
 
-		for h := range v {
-			keys = append(keys, h)
+		if !useColor {
+			fmt.Fprintf(stdout, "Set-Cookie: %s = %s (%s)\n", c.Name, c.Value, strings.Join(attrs, " "))
+			continue
 		}
 
-		sort.Strings(keys)
+		ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		fmt.Fprint(stdout, "Set-Cookie")
+		ct.ResetColor()
+		fmt.Fprint(stdout, ": ")
+		ct.ChangeColor(ct.Green, false, ct.None, false)
+		fmt.Fprint(stdout, c.Name)
+		ct.ResetColor()
+		fmt.Fprint(stdout, " = ")
+		ct.ChangeColor(ct.Yellow, false, ct.None, false)
+		fmt.Fprint(stdout, c.Value)
+		ct.ChangeColor(ct.Blue, false, ct.None, false)
+		fmt.Fprintf(stdout, " (%s)", strings.Join(attrs, " "))
+		ct.ResetColor()
+		fmt.Fprintln(stdout)
+	}
+}
 
-		fmt.Println("{")
-		needNL := false
-		for _, key := range keys {
-			if needNL {
-				fmt.Print(",\n")
-			}
-			needNL = true
-			for i := 0; i < depth; i++ {
-				fmt.Print("    ")
-			}
+// signRequest runs the shell command cmdline so it can sign req.
+//
+// The command is given the request on stdin: the method and URL on separate
+// lines, followed by the headers, a blank line, and the body.  The method and
+// URL are also in $GTTP_METHOD and $GTTP_URL.  The command should print
+// "Name: value" headers to add to the request.  If its output contains a
+// blank line, whatever follows replaces the request body.
+//
+// The body to send is returned.
+func signRequest(cmdline string, req *http.Request, body []byte) ([]byte, error) {
 
-			printJSON(depth+1, key, true)
-			fmt.Print(": ")
-			printJSON(depth+1, v[key], false)
-		}
-		fmt.Println("")
+	var in bytes.Buffer
+	fmt.Fprintf(&in, "%s\n%s\n", req.Method, req.URL)
+	req.Header.Write(&in)
+	in.WriteString("\n")
+	in.Write(body)
 
-		for i := 0; i < depth-1; i++ {
-			fmt.Print("    ")
-		}
-		fmt.Print("}")
+	cmd := exec.Command("sh", "-c", cmdline)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "GTTP_METHOD="+req.Method, "GTTP_URL="+req.URL.String())
 
-	case []interface{}:
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("signing command failed: %v", err)
+	}
 
-		if len(v) == 0 {
-			fmt.Print("[]")
-			break
-		}
+	// allow for commands which write CRLF
+	out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
 
-		fmt.Println("[")
-		needNL := false
-		for _, e := range v {
-			if needNL {
-				fmt.Print(",\n")
-			}
-			needNL = true
-			for i := 0; i < depth; i++ {
-				fmt.Print("    ")
-			}
+	headers, newBody, replace := bytes.Cut(out, []byte("\n\n"))
 
-			printJSON(depth+1, e, false)
+	for _, line := range strings.Split(string(headers), "\n") {
+		if line == "" {
+			continue
 		}
-		fmt.Println("")
-
-		for i := 0; i < depth-1; i++ {
-			fmt.Print("    ")
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("bad header from signing command: %q", line)
 		}
-		fmt.Print("]")
-	default:
-		fmt.Println("unknown type:", reflect.TypeOf(v))
+		req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
 	}
-}
-
-func printRequestHeaders(useColor bool, request *http.Request) {
 
-	u := request.URL.Path
-	if u == "" {
-		u = "/"
+	if !replace {
+		return body, nil
 	}
 
-	if request.URL.RawQuery != "" {
-		u += "?" + request.URL.RawQuery
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(newBody)), nil
 	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(newBody))
 
-	if useColor {
-		ct.ChangeColor(ct.Green, false, ct.None, false)
-		fmt.Printf("%s", request.Method)
-		ct.ChangeColor(ct.Cyan, false, ct.None, false)
-		fmt.Printf(" %s", u)
-		ct.ChangeColor(ct.Blue, false, ct.None, false)
-		fmt.Printf(" %s", request.Proto)
+	return newBody, nil
+}
+
+// writeDump writes a request or response as dumped by httputil, unless the
+// body looks binary
+func writeDump(dump []byte) {
+	if i := bytes.Index(dump, []byte("\r\n\r\n")); i != -1 && bytes.IndexByte(dump[i:], 0) != -1 {
+		stdout.Write(dump[:i+4])
+		io.WriteString(stdout, msgNoBinaryToTerminal)
 	} else {
-		fmt.Printf("%s %s %s", request.Method, u, request.Proto)
+		stdout.Write(dump)
 	}
-
-	fmt.Println()
-	printHeaders(useColor, request.Header)
-	fmt.Println()
+	stdout.Write([]byte{'\n', '\n'})
 }
 
-func printResponseHeaders(useColor bool, response *http.Response) {
+// printRateLimits writes a one line summary of any of the headers in names
+// present in headers to stderr, so running up against a rate limit is hard
+// to miss even when the response headers aren't being shown
+func printRateLimits(useColor bool, headers http.Header, names []string) {
+
+	var found []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && headers.Get(name) != "" {
+			found = append(found, name)
+		}
+	}
+
+	if len(found) == 0 {
+		return
+	}
+
+	ct.Writer = os.Stderr
+	defer func() { ct.Writer = stdout }()
 
 	if useColor {
-		ct.ChangeColor(ct.Blue, false, ct.None, false)
-		fmt.Printf("%s %s", response.Proto, response.Status[:3])
-		ct.ChangeColor(ct.Cyan, false, ct.None, false)
-		fmt.Printf("%s", response.Status[3:])
-	} else {
-		fmt.Printf("%s %s", response.Proto, response.Status)
+		ct.ChangeColor(ct.Red, false, ct.None, false)
+	}
+	fmt.Fprint(os.Stderr, "rate limit:")
+	if useColor {
+		ct.ResetColor()
+	}
+
+	for _, name := range found {
+		fmt.Fprint(os.Stderr, " ")
+		if useColor {
+			ct.ChangeColor(ct.Cyan, false, ct.None, false)
+		}
+		fmt.Fprint(os.Stderr, name)
+		if useColor {
+			ct.ResetColor()
+		}
+		fmt.Fprint(os.Stderr, "=")
+		if useColor {
+			ct.ChangeColor(ct.Yellow, false, ct.None, false)
+		}
+		fmt.Fprint(os.Stderr, headers.Get(name))
+		if useColor {
+			ct.ResetColor()
+		}
 	}
 
-	fmt.Println()
-	printHeaders(useColor, response.Header)
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 }
 
 func printHeaders(useColor bool, headers http.Header) {
@@ -652,23 +5658,113 @@ func printHeaders(useColor bool, headers http.Header) {
 	if useColor {
 		for _, k := range keys {
 			ct.ChangeColor(ct.Cyan, false, ct.None, false)
-			fmt.Printf("%s", k)
+			fmt.Fprintf(stdout, "%s", k)
 			ct.ChangeColor(ct.Black, false, ct.None, false)
 			ct.ResetColor()
-			fmt.Printf(": ")
+			fmt.Fprintf(stdout, ": ")
 			ct.ChangeColor(ct.Yellow, false, ct.None, false)
-			fmt.Printf("%s", headers[k][0])
+			fmt.Fprintf(stdout, "%s", headers[k][0])
 			ct.ResetColor()
-			fmt.Println()
+			fmt.Fprintln(stdout)
 		}
 
 	} else {
 		for _, k := range keys {
-			fmt.Printf("%s: %s\n", k, headers[k][0])
+			fmt.Fprintf(stdout, "%s: %s\n", k, headers[k][0])
 		}
 	}
 }
 
+// highlighter is a line-buffered writer which shows text matching re in
+// reverse video.  Matching ignores any colour codes already in the output.
+type highlighter struct {
+	w   io.Writer
+	re  *regexp.Regexp
+	buf []byte
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func (h *highlighter) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+	for {
+		i := bytes.IndexByte(h.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		if _, err := h.w.Write(h.highlightLine(h.buf[:i+1])); err != nil {
+			return 0, err
+		}
+		h.buf = h.buf[i+1:]
+	}
+}
+
+// Flush writes any incomplete final line
+func (h *highlighter) Flush() error {
+	_, err := h.w.Write(h.highlightLine(h.buf))
+	h.buf = nil
+	return err
+}
+
+func (h *highlighter) highlightLine(line []byte) []byte {
+
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		return append(h.highlightLine(line[:n-1]), '\n')
+	}
+
+	// find the matches in the text with the escape codes removed
+	codes := ansiEscape.FindAllIndex(line, -1)
+	plain := ansiEscape.ReplaceAll(line, nil)
+
+	matches := h.re.FindAllIndex(plain, -1)
+	if len(matches) == 0 {
+		return line
+	}
+
+	const on, off = "\x1b[7m", "\x1b[27m"
+
+	out := make([]byte, 0, len(line)+len(matches)*(len(on)+len(off)))
+	var pi int // offset into plain
+	var active bool
+	for i := 0; i < len(line); {
+		if len(codes) > 0 && codes[0][0] == i {
+			out = append(out, line[i:codes[0][1]]...)
+			// a reset would turn off our highlighting too
+			if active {
+				out = append(out, on...)
+			}
+			i = codes[0][1]
+			codes = codes[1:]
+			continue
+		}
+
+		// skip empty matches
+		for !active && len(matches) > 0 && matches[0][1] <= pi {
+			matches = matches[1:]
+		}
+		if !active && len(matches) > 0 && matches[0][0] == pi {
+			out = append(out, on...)
+			active = true
+		}
+
+		out = append(out, line[i])
+		i++
+		pi++
+
+		if active && matches[0][1] == pi {
+			out = append(out, off...)
+			active = false
+			matches = matches[1:]
+		}
+	}
+
+	if active {
+		out = append(out, off...)
+	}
+
+	return out
+}
+
 const msgNoBinaryToTerminal = "\n\n" +
 	"+-----------------------------------------+\n" +
 	"| NOTE: binary data not shown in terminal |\n" +
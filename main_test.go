@@ -0,0 +1,3638 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	ct "github.com/daviddengcn/go-colortext"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// TestMain lets the tests run gttp itself: with GTTP_TEST_MAIN set, the test
+// binary runs main with the arguments it was given instead of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("GTTP_TEST_MAIN") != "" {
+		os.Args = append([]string{"gttp"}, os.Args[1:]...)
+		if os.Getenv("GTTP_TEST_PAGER") != "" {
+			// as -pager does on a terminal, which the tests don't have
+			var err error
+			if pager, pagerInput, err = startPager(); err != nil {
+				log.Fatal(err)
+			}
+			stdout, ct.Writer = pagerInput, pagerInput
+		}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// result is what a run of gttp wrote, and how it exited
+type result struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+// gttp runs gttp with args and returns its result
+func gttp(t *testing.T, args ...string) result {
+	t.Helper()
+	return gttpWith(t, nil, nil, args...)
+}
+
+// gttpWith runs gttp with args, the extra environment variables in env, and
+// stdin as its input
+func gttpWith(t *testing.T, env []string, stdin io.Reader, args ...string) result {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GTTP_TEST_MAIN=1", "NO_COLOR=", "FORCE_COLOR=", "SSLKEYLOGFILE=")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running gttp: %v", err)
+	}
+
+	return result{stdout: stdout.String(), stderr: stderr.String(), code: code}
+}
+
+// sentRequest is a request as a test server received it
+type sentRequest struct {
+	Method           string
+	Path             string
+	RawQuery         string
+	Header           http.Header
+	Body             []byte
+	ContentLength    int64
+	TransferEncoding []string
+}
+
+// server starts a test server which records the requests it's sent and
+// answers them with handler, or an empty 200 if handler is nil.  The
+// returned function gives the requests received so far.
+func server(t *testing.T, handler http.HandlerFunc) (*httptest.Server, func() []sentRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []sentRequest
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, sentRequest{
+			Method:           r.Method,
+			Path:             r.URL.Path,
+			RawQuery:         r.URL.RawQuery,
+			Header:           r.Header.Clone(),
+			Body:             body,
+			ContentLength:    r.ContentLength,
+			TransferEncoding: r.TransferEncoding,
+		})
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []sentRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentRequest(nil), requests...)
+	}
+}
+
+// respond returns a handler which sends body with the given content type
+func respond(contentType, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}
+}
+
+// writeFile writes contents to name in a temporary directory and returns its
+// path
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerboseRequestBody(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	badJSON := writeFile(t, "bad.json", `{"a": }`)
+
+	tests := []struct {
+		name string
+		args []string
+		want string // in the output
+		body string // as the server got it
+	}{
+		{
+			name: "json",
+			args: []string{"-v", srv.URL, "a=1"},
+			want: "{\n    \"a\": \"1\"\n}",
+			body: `{"a":"1"}`,
+		},
+		{
+			name: "invalid json",
+			args: []string{"-v", "-body-file", badJSON, srv.URL, "Content-Type:application/json"},
+			want: `{"a": }`,
+			body: `{"a": }`,
+		},
+		{
+			name: "not json",
+			args: []string{"-v", "-f", srv.URL, "a=1"},
+			want: "\na=1\n",
+			body: "a=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stdout, tt.want) {
+				t.Errorf("output doesn't contain %q:\n%s", tt.want, r.stdout)
+			}
+			got := sent()
+			if len(got) != before+1 {
+				t.Fatalf("server got %d requests, want 1", len(got)-before)
+			}
+			if body := string(got[len(got)-1].Body); body != tt.body {
+				t.Errorf("server got body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestVerboseStreamedBody(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /dev/fd")
+	}
+
+	srv, sent := server(t, nil)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.WriteString(pw, "streamed\n")
+		pw.Close()
+	}()
+
+	cmd := exec.Command(os.Args[0], "-v", "-body-file", "/dev/fd/3", srv.URL)
+	cmd.Env = append(os.Environ(), "GTTP_TEST_MAIN=1")
+	cmd.ExtraFiles = []*os.File{pr}
+	out, err := cmd.CombinedOutput()
+	pr.Close()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	if !strings.Contains(string(out), "Transfer-Encoding: chunked") {
+		t.Errorf("request wasn't shown as chunked:\n%s", out)
+	}
+	got := sent()
+	if len(got) != 1 || string(got[0].Body) != "streamed\n" {
+		t.Errorf("server got %+v, want one request with the streamed body", got)
+	}
+}
+
+func TestStreamedBodyOnce(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /dev/fd")
+	}
+
+	// streamed runs gttp with args, and a pipe for its body on /dev/fd/3
+	streamed := func(t *testing.T, args ...string) (string, error) {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			io.WriteString(pw, "streamed\n")
+			pw.Close()
+		}()
+
+		cmd := exec.Command(os.Args[0], append([]string{"-body-file", "/dev/fd/3"}, args...)...)
+		cmd.Env = append(os.Environ(), "GTTP_TEST_MAIN=1")
+		cmd.ExtraFiles = []*os.File{pr}
+		out, err := cmd.CombinedOutput()
+		pr.Close()
+		return string(out), err
+	}
+
+	t.Run("reset", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		var conns int32
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&conns, 1)
+				// read the request, then hang up without answering
+				if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					io.Copy(io.Discard, req.Body)
+				}
+				conn.Close()
+			}
+		}()
+
+		out, err := streamed(t, "-force-retry", "http://"+ln.Addr().String())
+		if err == nil {
+			t.Fatalf("succeeded without a response:\n%s", out)
+		}
+		if strings.Contains(out, "retrying after") {
+			t.Errorf("retried with the pipe already read:\n%s", out)
+		}
+		if n := atomic.LoadInt32(&conns); n != 1 {
+			t.Errorf("server got %d connections, want 1", n)
+		}
+	})
+
+	t.Run("dump", func(t *testing.T) {
+		srv, sent := server(t, nil)
+		dump := filepath.Join(t.TempDir(), "body")
+
+		out, err := streamed(t, "-dump-request-body", dump, srv.URL)
+		if err == nil {
+			t.Fatalf("succeeded:\n%s", out)
+		}
+		if want := "-dump-request-body can't keep a copy of a body streamed from a pipe"; !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+		if _, err := os.Stat(dump); err == nil {
+			t.Errorf("%s written", dump)
+		}
+		if got := sent(); len(got) != 0 {
+			t.Errorf("server got %d requests, want none", len(got))
+		}
+	})
+}
+
+func TestGetData(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		name  string
+		args  []string
+		query string
+	}{
+		{"body items", []string{"-G", srv.URL, "a=1", "b=2"}, "a=1&b=2"},
+		{"mixed items", []string{"-G", srv.URL, "a==1", "a=2", "a=3"}, "a=1&a=2&a=3"},
+		{"json items", []string{"-get", srv.URL, "n:=1"}, "n=1"},
+		{"urlencoded", []string{"-G", "-data-urlencode", "q=a b", srv.URL}, "q=a+b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(got))
+			}
+			req := got[0]
+			if req.Method != "GET" {
+				t.Errorf("method %s, want GET", req.Method)
+			}
+			if req.RawQuery != tt.query {
+				t.Errorf("query %q, want %q", req.RawQuery, tt.query)
+			}
+			if len(req.Body) != 0 {
+				t.Errorf("body %q, want none", req.Body)
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+
+	var hits int32
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path != "/no-store" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		io.WriteString(w, "body of "+r.URL.Path+"\n")
+	})
+
+	// entryFor returns where the cache keeps the response for u
+	entryFor := func(dir, u string) string {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "*/*")
+		return cacheEntry(dir, req)
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string // fetched in order
+		hits     int32
+		unusable bool // the cache entry can't be written
+	}{
+		{"hit", []string{"/a", "/a"}, 1, false},
+		{"miss", []string{"/a", "/b"}, 2, false},
+		{"no-store", []string{"/no-store", "/no-store"}, 2, false},
+		{"write failure", []string{"/a", "/a"}, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			atomic.StoreInt32(&hits, 0)
+			for _, p := range tt.paths {
+				if tt.unusable {
+					// a directory where the entry should go stops it being written
+					if err := os.MkdirAll(entryFor(dir, srv.URL+p), 0700); err != nil {
+						t.Fatal(err)
+					}
+				}
+				r := gttp(t, "-cache-dir", dir, srv.URL+p)
+				if r.code != 0 {
+					t.Fatalf("exit status %d: %s", r.code, r.stderr)
+				}
+				if want := "body of " + p + "\n"; !strings.Contains(r.stdout, want) {
+					t.Errorf("output %q doesn't contain %q", r.stdout, want)
+				}
+				if tt.unusable && !strings.Contains(r.stderr, "can't cache response") {
+					t.Errorf("no warning about the cache: %q", r.stderr)
+				}
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.hits {
+				t.Errorf("server hit %d times, want %d", got, tt.hits)
+			}
+		})
+	}
+}
+
+func TestCacheVariants(t *testing.T) {
+
+	gzipped := encode(t, "gzip", `{"a":1}`)
+
+	var hits int32
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Vary", "Accept-Encoding")
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(gzipped)
+				return
+			}
+		case "/user-agent":
+			w.Header().Set("Vary", "User-Agent")
+		}
+		io.WriteString(w, `{"a":1}`)
+	})
+
+	tests := []struct {
+		name string
+		runs [][]string
+		hits int32
+	}{
+		{"compressed then plain", [][]string{{"-compressed", srv.URL + "/gzip"}, {srv.URL + "/gzip"}}, 2},
+		{"plain then compressed", [][]string{{srv.URL + "/gzip"}, {"-compressed", srv.URL + "/gzip"}}, 2},
+		{"same encoding", [][]string{{"-compressed", srv.URL + "/gzip"}, {"-compressed", srv.URL + "/gzip"}}, 1},
+		{"authorization", [][]string{{srv.URL + "/", "Authorization:a"}, {srv.URL + "/", "Authorization:b"}}, 2},
+		{"unkeyed vary", [][]string{{srv.URL + "/user-agent"}, {srv.URL + "/user-agent"}}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			atomic.StoreInt32(&hits, 0)
+			for _, args := range tt.runs {
+				r := gttp(t, append([]string{"-cache-dir", dir}, args...)...)
+				if r.code != 0 {
+					t.Fatalf("exit status %d: %s", r.code, r.stderr)
+				}
+				if !strings.Contains(r.stdout, `"a": 1`) {
+					t.Errorf("output doesn't contain the decoded body:\n%q", r.stdout)
+				}
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.hits {
+				t.Errorf("server hit %d times, want %d", got, tt.hits)
+			}
+		})
+	}
+}
+
+// rawServer listens for one connection, reads a request from it and answers
+// with an empty 200.  The returned channel gets the bytes of the request
+// exactly as they were sent.
+func rawServer(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(got)
+			return
+		}
+		defer conn.Close()
+
+		var raw bytes.Buffer
+		req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, &raw)))
+		if err == nil {
+			io.Copy(io.Discard, req.Body)
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		got <- raw.Bytes()
+	}()
+
+	return "http://" + ln.Addr().String(), got
+}
+
+// headerNames returns the names of the headers in a raw request, in order
+func headerNames(raw []byte) []string {
+	var names []string
+	head, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestHeaderOrder(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		args  []string
+		first []string
+	}{
+		{"given order", []string{"-header-order", "X-B,X-A,Host"}, []string{"X-B", "X-A", "Host"}},
+		{"case insensitive", []string{"-header-order", "user-agent,x-a"}, []string{"User-Agent", "X-A"}},
+		{"unsent headers skipped", []string{"-header-order", "X-Missing,X-A"}, []string{"X-A"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, got := rawServer(t)
+			args := append(tt.args, u, "X-A:1", "X-B:2")
+			r := gttp(t, args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			names := headerNames(<-got)
+			if len(names) < len(tt.first) {
+				t.Fatalf("headers %q, want %q first", names, tt.first)
+			}
+			for i, name := range tt.first {
+				if names[i] != name {
+					t.Fatalf("headers %q, want %q first", names, tt.first)
+				}
+			}
+			rest := names[len(tt.first):]
+			if !sort.StringsAreSorted(rest) {
+				t.Errorf("remaining headers %q aren't sorted", rest)
+			}
+		})
+	}
+}
+
+func TestContentLength(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		args    []string
+		chunked bool
+	}{
+		{"default", nil, false},
+		{"header order", []string{"-header-order", "Host"}, false},
+		{"no content length", []string{"-no-content-length"}, true},
+		{"no content length with header order", []string{"-no-content-length", "-header-order", "Host"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, got := rawServer(t)
+			args := append(tt.args, u, "a=1")
+			r := gttp(t, args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+
+			raw := <-got
+			var lengths, encodings int
+			for _, name := range headerNames(raw) {
+				switch http.CanonicalHeaderKey(name) {
+				case "Content-Length":
+					lengths++
+				case "Transfer-Encoding":
+					encodings++
+				}
+			}
+
+			if tt.chunked {
+				if lengths != 0 || encodings != 1 {
+					t.Errorf("%d Content-Length and %d Transfer-Encoding headers, want it chunked:\n%s", lengths, encodings, raw)
+				}
+				if !bytes.HasSuffix(raw, []byte("\r\n9\r\n{\"a\":\"1\"}\r\n0\r\n\r\n")) {
+					t.Errorf("body wasn't chunked:\n%q", raw)
+				}
+				return
+			}
+
+			if lengths != 1 || encodings != 0 {
+				t.Errorf("%d Content-Length and %d Transfer-Encoding headers, want one Content-Length:\n%s", lengths, encodings, raw)
+			}
+			if !bytes.HasSuffix(raw, []byte("\r\n\r\n{\"a\":\"1\"}")) {
+				t.Errorf("body wasn't sent as it is:\n%q", raw)
+			}
+		})
+	}
+}
+
+func TestCSVTable(t *testing.T) {
+
+	tests := []struct {
+		name string
+		csv  string
+		want string
+	}{
+		{
+			name: "ascii",
+			csv:  "name,age\nbob,40\nalexander,3\n",
+			want: "name       age\nbob        40\nalexander  3\n",
+		},
+		{
+			name: "wide characters",
+			csv:  "名前,age\n太郎,3\nbob,40\n",
+			want: "名前  age\n太郎  3\nbob   40\n",
+		},
+		{
+			name: "ragged rows",
+			csv:  "a,b\n1\n",
+			want: "a,b\n1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := server(t, respond("text/csv", tt.csv))
+			r := gttp(t, srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stdout, "\n\n"+tt.want) {
+				t.Errorf("got\n%s\nwant the body\n%s", r.stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONTable(t *testing.T) {
+
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{
+			name: "flat objects",
+			json: `[{"id":1,"name":"ann"},{"id":22,"name":"bob"},{"id":333,"name":"cy"}]`,
+			want: "id   name\n1    ann\n22   bob\n333  cy\n",
+		},
+		{
+			name: "missing keys and nested values",
+			json: `[{"id":1,"tags":["a"]},{"id":2,"name":"bob"},{"id":3,"name":"cy","tags":{"x":1}}]`,
+			want: "id  name  tags\n1         […]\n2   bob   \n3   cy    {…}\n",
+		},
+		{
+			name: "wide characters",
+			json: `[{"name":"太郎","n":1},{"name":"bob","n":2},{"name":"ünïcode","n":3}]`,
+			want: "n  name\n1  太郎\n2  bob\n3  ünïcode\n",
+		},
+		{
+			name: "wide characters before another column",
+			json: `[{"a":"太郎","b":1},{"a":"bob","b":2},{"a":"ünï","b":3}]`,
+			want: "a     b\n太郎  1\nbob   2\nünï   3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := server(t, respond("application/json", tt.json))
+			r := gttp(t, "-table", srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stdout, "\n\n"+tt.want) {
+				t.Errorf("got\n%s\nwant the body\n%s", r.stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestPagerWaitedFor(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "body of "+r.URL.Path+"\n")
+	})
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want string // in what was paged
+	}{
+		{"success", []string{srv.URL + "/a"}, 0, "body of /a"},
+		{"bad status", []string{srv.URL + "/missing"}, 5, "body of /missing"},
+		{"diff", []string{"-diff", srv.URL + "/b", srv.URL + "/a"}, 1, "body of /b"},
+		{"as httpie", []string{"-as-httpie", srv.URL + "/a", "x==1"}, 0, "http http://"},
+		{"fatal", []string{"-cookie-jar", "/nonexistent/jar", srv.URL + "/a"}, 1, "body of /a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paged := filepath.Join(t.TempDir(), "paged")
+			// a slow pager that doesn't hold our stdout open, so the file is only
+			// complete when gttp exits if gttp waited for it
+			env := []string{"GTTP_TEST_PAGER=1", "PAGER=exec >/dev/null 2>&1; sleep 0.2; cat > " + paged}
+			r := gttpWith(t, env, nil, tt.args...)
+			if r.code != tt.code {
+				t.Errorf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			b, err := os.ReadFile(paged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), tt.want) {
+				t.Errorf("paged output %q doesn't contain %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTP2Settings(t *testing.T) {
+
+	var mu sync.Mutex
+	conns := 0
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"direct", []string{srv.URL}},
+		{"connect-to", []string{"-connect-to", "gttp.invalid:" + port + ":127.0.0.1:" + port, "https://gttp.invalid:" + port}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			conns = 0
+			mu.Unlock()
+
+			args := append([]string{"-h2-settings", "-k", "-repeat", "2"}, tt.args...)
+			r := gttp(t, args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if n := strings.Count(r.stdout, "HTTP/2 settings:"); n != 2 {
+				t.Errorf("settings shown %d times, want once per request:\n%s", n, r.stdout)
+			}
+			if !strings.Contains(r.stdout, "MAX_CONCURRENT_STREAMS=") {
+				t.Errorf("no MAX_CONCURRENT_STREAMS in the settings:\n%s", r.stdout)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if conns != 1 {
+				t.Errorf("server got %d connections, want only the one the requests were sent on", conns)
+			}
+		})
+	}
+
+	t.Run("verbose", func(t *testing.T) {
+		// -v alone leaves HTTP/2 to net/http
+		r := gttp(t, "-v", "-k", srv.URL)
+		if r.code != 0 {
+			t.Fatalf("exit status %d: %s", r.code, r.stderr)
+		}
+		if strings.Contains(r.stdout, "HTTP/2 settings:") {
+			t.Errorf("settings shown without -h2-settings:\n%s", r.stdout)
+		}
+		if !strings.Contains(r.stdout, "HTTP/2.0 200") {
+			t.Errorf("request not sent over HTTP/2:\n%s", r.stdout)
+		}
+	})
+}
+
+func TestFlagValidation(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-headers", "-body"}, "-headers and -body can't be used together"},
+		{[]string{"-i", "-headers"}, "-i and -headers can't be used together"},
+		{[]string{"-G", "-f"}, "-G and -f can't be used together"},
+		{[]string{"-max-pages", "3"}, "-max-pages needs -paginate"},
+		{[]string{"-concurrency", "4"}, "-concurrency needs -ndjson"},
+		{[]string{"-proto-message", "pkg.Msg"}, "-proto-message needs -proto-descriptor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			r := gttp(t, append(tt.args, srv.URL)...)
+			if r.code != 1 {
+				t.Errorf("exit status %d, want 1", r.code)
+			}
+			if !strings.Contains(r.stderr, tt.err) {
+				t.Errorf("error %q, want %q", r.stderr, tt.err)
+			}
+		})
+	}
+
+	// a flag explicitly turned off doesn't conflict
+	if r := gttp(t, "-headers", "-body=false", srv.URL); r.code != 0 {
+		t.Errorf("-headers -body=false: exit status %d: %s", r.code, r.stderr)
+	}
+
+	if n := len(sent()); n != 1 {
+		t.Errorf("server got %d requests, want only the valid one", n)
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+
+	// the certificate from an httptest TLS server, for a QUIC one
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsConfig := tlsSrv.TLS.Clone()
+	tlsSrv.Close()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "over "+r.Proto+"\n")
+		}),
+	}
+	go srv.Serve(udp)
+	t.Cleanup(func() { srv.Close() })
+
+	_, port, _ := net.SplitHostPort(udp.LocalAddr().String())
+
+	// nothing listening
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want string // in the output
+		err  string // in the errors
+	}{
+		{
+			name: "get",
+			args: []string{"-http3", "-k", "https://127.0.0.1:" + port + "/"},
+			want: "over HTTP/3.0",
+		},
+		{
+			name: "verbose",
+			args: []string{"-http3", "-k", "-v", "https://127.0.0.1:" + port + "/"},
+			want: "HTTP/3.0 200 OK",
+			err:  "negotiated protocol: h3",
+		},
+		{
+			name: "connect-to",
+			args: []string{"-http3", "-k", "-connect-to", "gttp.invalid:" + port + ":127.0.0.1:" + port, "https://gttp.invalid:" + port + "/"},
+			want: "over HTTP/3.0",
+		},
+		{
+			name: "no http3 server",
+			args: []string{"-http3", "-k", "-t", "1s", "https://" + closedAddr + "/"},
+			code: 1,
+			err:  "does the server support it?",
+		},
+		{
+			name: "proxy",
+			args: []string{"-http3", "-proxy", "http://127.0.0.1:1", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -proxy can't be used together",
+		},
+		{
+			name: "interface",
+			args: []string{"-http3", "-interface", "127.0.0.1", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -interface can't be used together",
+		},
+		{
+			name: "dns",
+			args: []string{"-http3", "-dns", "127.0.0.1:53", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -dns can't be used together",
+		},
+		{
+			name: "keepalive",
+			args: []string{"-http3", "-keepalive", "1s", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -keepalive can't be used together",
+		},
+		{
+			name: "fallback delay",
+			args: []string{"-http3", "-fallback-delay", "1s", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -fallback-delay can't be used together",
+		},
+		{
+			name: "h2 settings",
+			args: []string{"-http3", "-h2-settings", "https://127.0.0.1:" + port + "/"},
+			code: 1,
+			err:  "-http3 and -h2-settings can't be used together",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if !strings.Contains(r.stdout, tt.want) {
+				t.Errorf("output doesn't contain %q:\n%s", tt.want, r.stdout)
+			}
+			if !strings.Contains(r.stderr, tt.err) {
+				t.Errorf("errors don't contain %q:\n%s", tt.err, r.stderr)
+			}
+		})
+	}
+}
+
+func TestQuoteJSON(t *testing.T) {
+
+	tests := []struct {
+		s      string
+		escape bool
+		want   string
+	}{
+		{"plain", false, `"plain"`},
+		{"héllo 世界 😀", false, `"héllo 世界 😀"`},
+		{"héllo 世界 😀", true, `"h\u00e9llo \u4e16\u754c \ud83d\ude00"`},
+		{"quote\" back\\ nl\n tab\t", false, `"quote\" back\\ nl\n tab\t"`},
+		{"\x01 \u2028", false, `"\u0001 \u2028"`},
+		{"bad \xff", false, "\"bad \uFFFD\""},
+	}
+
+	for _, tt := range tests {
+		if got := quoteJSON(tt.s, tt.escape); got != tt.want {
+			t.Errorf("quoteJSON(%q, %v) = %s, want %s", tt.s, tt.escape, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeUnicode(t *testing.T) {
+
+	srv, _ := server(t, respond("application/json", `{"s":"日本語 🎉"}`))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, `"s": "日本語 🎉"`},
+		{[]string{"-escape-unicode"}, `"s": "\u65e5\u672c\u8a9e \ud83c\udf89"`},
+	}
+
+	for _, tt := range tests {
+		r := gttp(t, append(tt.args, srv.URL)...)
+		if r.code != 0 {
+			t.Fatalf("%v: exit status %d: %s", tt.args, r.code, r.stderr)
+		}
+		if !strings.Contains(r.stdout, tt.want) {
+			t.Errorf("%v: output doesn't contain %s:\n%s", tt.args, tt.want, r.stdout)
+		}
+	}
+}
+
+func TestSortArrays(t *testing.T) {
+
+	tests := []struct {
+		name string
+		json string
+		args []string
+		want string
+	}{
+		{"strings", `{"a":["c","a","b"]}`, nil, "[\n        \"a\",\n        \"b\",\n        \"c\"\n    ]"},
+		{"numbers", `[10,9,1.5,-2]`, nil, "[\n    -2,\n    1.5,\n    9,\n    10\n]"},
+		{"bools", `[true,false]`, nil, "[\n    false,\n    true\n]"},
+		{"objects untouched", `[{"b":1},{"a":2}]`, nil, "[\n    {\n        \"b\": 1\n    },\n    {\n        \"a\": 2\n    }\n]"},
+		{"mixed untouched", `[2,"1"]`, nil, "[\n    2,\n    \"1\"\n]"},
+		{"flatten", `{"a":[3,1,2]}`, []string{"-flatten"}, "a[0] = 1\na[1] = 2\na[2] = 3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := server(t, respond("application/json", tt.json))
+			args := append([]string{"-sort-arrays"}, tt.args...)
+			r := gttp(t, append(args, srv.URL)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stdout, tt.want) {
+				t.Errorf("output doesn't contain\n%s\ngot\n%s", tt.want, r.stdout)
+			}
+		})
+	}
+
+	t.Run("request body untouched", func(t *testing.T) {
+		srv, sent := server(t, nil)
+		r := gttp(t, "-sort-arrays", srv.URL, "a:=[3,1,2]")
+		if r.code != 0 {
+			t.Fatalf("exit status %d: %s", r.code, r.stderr)
+		}
+		got := sent()
+		if len(got) != 1 {
+			t.Fatalf("server got %d requests, want 1", len(got))
+		}
+		if got[0].Method != "POST" || string(got[0].Body) != `{"a":[3,1,2]}` {
+			t.Errorf("server got %s %s, want POST {\"a\":[3,1,2]}", got[0].Method, got[0].Body)
+		}
+	})
+}
+
+func TestFlatten(t *testing.T) {
+
+	tests := []struct {
+		name string
+		json string
+		code int
+		want []string // lines in the output
+	}{
+		{
+			name: "nested",
+			json: `{"a":{"b":[1,{"c":null}],"d":"x"},"e":true}`,
+			want: []string{`a.b[0] = 1`, `a.b[1].c = null`, `a.d = "x"`, `e = true`},
+		},
+		{
+			name: "awkward keys",
+			json: `{"b c":1,"":2,"1x":3,"ok_1":4}`,
+			want: []string{`["b c"] = 1`, `[""] = 2`, `["1x"] = 3`, `ok_1 = 4`},
+		},
+		{
+			name: "empty containers",
+			json: `{"a":[],"b":{}}`,
+			want: []string{`a = []`, `b = {}`},
+		},
+		{
+			name: "scalar",
+			json: `5`,
+			want: []string{`. = 5`},
+		},
+		{
+			name: "invalid",
+			json: `{"a":`,
+			code: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := server(t, respond("application/json", tt.json))
+			r := gttp(t, "-flatten", "-body", srv.URL)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			lines := strings.Split(r.stdout, "\n")
+			for _, want := range tt.want {
+				found := false
+				for _, l := range lines {
+					found = found || l == want
+				}
+				if !found {
+					t.Errorf("no line %q in\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestKeysValues(t *testing.T) {
+
+	srv, _ := server(t, respond("application/json", `{"a":{"b":[1,2],"c":"x"},"d":true}`))
+
+	tests := []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"-keys"}, 0, "a\nd\n"},
+		{[]string{"-keys", "-recursive"}, 0, "a\na.b\na.b[0]\na.b[1]\na.c\nd\n"},
+		{[]string{"-values"}, 0, "{\"b\":[1,2],\"c\":\"x\"}\ntrue\n"},
+		{[]string{"-values", "-recursive"}, 0, "1\n2\nx\ntrue\n"},
+		{[]string{"-keys", "-pointer", "/a"}, 0, "b\nc\n"},
+		{[]string{"-keys", "-pointer", "/a/b"}, 0, "[0]\n[1]\n"},
+		{[]string{"-values", "-pointer", "/a/b"}, 0, "1\n2\n"},
+		{[]string{"-keys", "-flatten"}, 1, ""},
+		{[]string{"-values", "-flatten"}, 1, ""},
+		{[]string{"-keys", "-values"}, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			r := gttp(t, append(tt.args, "-body", srv.URL)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if !strings.HasPrefix(r.stdout, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", r.stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+
+	srv, _ := server(t, respond("application/json", `{"a":{"b":{"c":{"d":1}},"l":[[1,2]],"n":1}}`))
+
+	tests := []struct {
+		depth string
+		want  string
+	}{
+		{"1", "{\n    \"a\": {… 3 keys}\n}"},
+		{"2", "{\n    \"a\": {\n        \"b\": {… 1 keys},\n        \"l\": [… 1 items],\n        \"n\": 1\n    }\n}"},
+		{"4", "\"d\": 1"},
+	}
+
+	for _, tt := range tests {
+		r := gttp(t, "-max-depth", tt.depth, "-body", srv.URL)
+		if r.code != 0 {
+			t.Fatalf("-max-depth %s: exit status %d: %s", tt.depth, r.code, r.stderr)
+		}
+		if !strings.Contains(r.stdout, tt.want) {
+			t.Errorf("-max-depth %s: got\n%s\nwant\n%s", tt.depth, r.stdout, tt.want)
+		}
+	}
+}
+
+func TestFoldStrings(t *testing.T) {
+
+	long := strings.Repeat("x", 500)
+	srv, _ := server(t, respond("application/json", `{"long":"`+long+`","short":"abc","wide":"日本語日本語","`+long+`":1}`))
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{`"long": "` + long + `"`}},
+		{[]string{"-fold-strings", "80"}, []string{
+			`"long": "` + long[:80] + `…" (500 chars)`,
+			`"short": "abc",`,
+			// keys are left alone
+			`"` + long + `": 1`,
+		}},
+		{[]string{"-fold-strings", "3"}, []string{`"wide": "日本語…" (6 chars)`}},
+	}
+
+	for _, tt := range tests {
+		r := gttp(t, append(tt.args, "-body", srv.URL)...)
+		if r.code != 0 {
+			t.Fatalf("%v: exit status %d: %s", tt.args, r.code, r.stderr)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(r.stdout, want) {
+				t.Errorf("%v: output doesn't contain %s:\n%s", tt.args, want, r.stdout)
+			}
+		}
+	}
+}
+
+func TestWebDAVMethods(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "REPORT"} {
+		t.Run(method, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, method, srv.URL+"/dav/")
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 || got[0].Method != method || got[0].Path != "/dav/" {
+				t.Errorf("server got %+v, want one %s /dav/", got, method)
+			}
+		})
+	}
+
+	t.Run("with body", func(t *testing.T) {
+		before := len(sent())
+		r := gttp(t, "PROPFIND", srv.URL, "Depth:1", "prop=displayname")
+		if r.code != 0 {
+			t.Fatalf("exit status %d: %s", r.code, r.stderr)
+		}
+		got := sent()[before:]
+		if len(got) != 1 {
+			t.Fatalf("server got %d requests, want 1", len(got))
+		}
+		if got[0].Method != "PROPFIND" || got[0].Header.Get("Depth") != "1" || string(got[0].Body) != `{"prop":"displayname"}` {
+			t.Errorf("server got %s with Depth %q and body %s", got[0].Method, got[0].Header.Get("Depth"), got[0].Body)
+		}
+	})
+}
+
+func TestHighlighter(t *testing.T) {
+
+	const on, off = "\x1b[7m", "\x1b[27m"
+
+	tests := []struct {
+		re    string
+		input string
+		want  string
+	}{
+		{"b+", "abbbc\n", "a" + on + "bbb" + off + "c\n"},
+		{"x", "abc\n", "abc\n"},
+		{"a", "a a\nb\na", on + "a" + off + " " + on + "a" + off + "\nb\n" + on + "a" + off},
+		{"b*", "abc\n", "a" + on + "b" + off + "c\n"},
+		// a match across colour codes keeps going after a reset
+		{"bc", "a\x1b[33mb\x1b[0mc\n", "a\x1b[33m" + on + "b\x1b[0m" + on + "c" + off + "\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		h := &highlighter{w: &buf, re: regexp.MustCompile(tt.re)}
+		io.WriteString(h, tt.input)
+		h.Flush()
+		if got := buf.String(); got != tt.want {
+			t.Errorf("highlight %q in %q = %q, want %q", tt.re, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Token", "secret")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"token":"secret"}`)
+	})
+
+	r := gttp(t, "-highlight", "sec.et", srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	for _, want := range []string{"X-Token: \x1b[7msecret\x1b[27m\n", "\"token\": \"\x1b[7msecret\x1b[27m\""} {
+		if !strings.Contains(r.stdout, want) {
+			t.Errorf("output doesn't contain %q:\n%q", want, r.stdout)
+		}
+	}
+
+	if r := gttp(t, "-highlight", "(", srv.URL); r.code != 1 || !strings.Contains(r.stderr, "bad highlight regexp") {
+		t.Errorf("bad regexp: exit status %d: %s", r.code, r.stderr)
+	}
+}
+
+func TestHighlightFinalLine(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "token-xyz")
+	})
+	request := writeFile(t, "request", "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"end of main", []string{srv.URL}, 0},
+		{"exit status", []string{srv.URL + "/missing"}, 5},
+		{"raw request", []string{"-raw-request", request, srv.URL}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append([]string{"-highlight", "xyz"}, tt.args...)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if want := "token-\x1b[7mxyz\x1b[27m"; !strings.Contains(r.stdout, want) {
+				t.Errorf("output doesn't contain %q:\n%q", want, r.stdout)
+			}
+		})
+	}
+}
+
+func TestParseMethod(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"GET", "GET", true},
+		{"get", "GET", true},
+		{"Post", "POST", true},
+		{"QUERY", "QUERY", true},
+		{"query", "QUERY", true},
+		{"PROPFIND", "PROPFIND", true},
+		{"X-CUSTOM_1", "X-CUSTOM_1", true},
+		{"propfind", "", false},
+		{"example.com", "", false},
+		{"GE(T", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseMethod(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseMethod(%q) = %q, %v, want %q, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMethodArgument(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		args   []string
+		code   int
+		method string
+	}{
+		{[]string{"get", srv.URL}, 0, "GET"},
+		{[]string{"delete", srv.URL}, 0, "DELETE"},
+		{[]string{"QUERY", srv.URL}, 0, "QUERY"},
+		{[]string{"query", srv.URL, "a==1"}, 0, "QUERY"},
+		// not a method, so taken as the URL
+		{[]string{"ge(t", srv.URL}, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args[:1], " "), func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if tt.method == "" {
+				if len(got) != 0 {
+					t.Errorf("server got %+v, want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Method != tt.method {
+				t.Errorf("server got %+v, want one %s", got, tt.method)
+			}
+		})
+	}
+}
+
+func TestByteSize(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want byteSize
+		str  string
+	}{
+		{"0", 0, "0"},
+		{"100", 100, "100"},
+		{"1K", 1 << 10, "1K"},
+		{"1kb", 1 << 10, "1K"},
+		{"10M", 10 << 20, "10M"},
+		{"2G", 2 << 30, "2G"},
+		{"1500", 1500, "1500"},
+	}
+
+	for _, tt := range tests {
+		var b byteSize
+		if err := b.Set(tt.s); err != nil {
+			t.Errorf("Set(%q): %v", tt.s, err)
+			continue
+		}
+		if b != tt.want || b.String() != tt.str {
+			t.Errorf("Set(%q) = %d (%s), want %d (%s)", tt.s, b, b, tt.want, tt.str)
+		}
+	}
+
+	for _, s := range []string{"", "-1", "1T", "M", "1.5M"} {
+		var b byteSize
+		if err := b.Set(s); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", s, b)
+		}
+	}
+}
+
+func TestBodySizeWarning(t *testing.T) {
+
+	srv, _ := server(t, nil)
+	big := writeFile(t, "big.txt", strings.Repeat("a", 2048))
+	small := writeFile(t, "small.txt", "a")
+
+	const embedding = "use -m to upload it as multipart"
+	const large = "warning: request body is"
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+		not  []string
+	}{
+		{"form embedding large file", []string{"-warn-body-size", "1K", "-f", "-m=false", srv.URL, "f@" + big}, []string{embedding, large}, nil},
+		{"json embedding large file", []string{"-warn-body-size", "1K", "-m=false", srv.URL, "f@" + big}, []string{embedding, large}, nil},
+		{"multipart upload", []string{"-warn-body-size", "1K", "-f", srv.URL, "f@" + big}, []string{large}, []string{embedding}},
+		{"small file", []string{"-warn-body-size", "1K", "-f", "-m=false", srv.URL, "f@" + small}, nil, []string{embedding, large}},
+		{"disabled", []string{"-warn-body-size", "0", "-f", "-m=false", srv.URL, "f@" + big}, nil, []string{embedding, large}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, tt.args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(r.stderr, w) {
+					t.Errorf("no warning %q in %q", w, r.stderr)
+				}
+			}
+			for _, w := range tt.not {
+				if strings.Contains(r.stderr, w) {
+					t.Errorf("unexpected warning %q in %q", w, r.stderr)
+				}
+			}
+		})
+	}
+}
+
+func TestTrace(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Reply", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "made it")
+	})
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "get",
+			args: []string{srv.URL + "/p", "q==1"},
+			want: []string{"GET /p?q=1 HTTP/1.1\r\nHost: " + host + "\r\n", "HTTP/1.1 201 Created\r\n", "X-Reply: yes\r\n", "\r\n\r\nmade it"},
+		},
+		{
+			name: "post",
+			args: []string{srv.URL, "a=1"},
+			want: []string{"POST / HTTP/1.1\r\n", "Content-Length: 9\r\n", "\r\n\r\n{\"a\":\"1\"}", "HTTP/1.1 201 Created\r\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append([]string{"-trace"}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(r.stdout, want) {
+					t.Errorf("trace doesn't contain %q:\n%q", want, r.stdout)
+				}
+			}
+			if strings.Index(r.stdout, "HTTP/1.1\r\n") > strings.Index(r.stdout, "HTTP/1.1 201") {
+				t.Errorf("response before request:\n%s", r.stdout)
+			}
+		})
+	}
+}
+
+func TestMethodWithBody(t *testing.T) {
+
+	tests := []struct {
+		method       string
+		provided     bool
+		allowGetBody bool
+		want         string // empty for an error
+	}{
+		{"GET", false, false, "POST"},
+		{"DELETE", true, false, "DELETE"},
+		{"PUT", true, false, "PUT"},
+		{"GET", true, false, ""},
+		{"HEAD", true, false, ""},
+		{"GET", true, true, "GET"},
+		{"TRACE", true, true, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := methodWithBody(tt.method, tt.provided, tt.allowGetBody)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("methodWithBody(%s, %v, %v) = %s, want an error", tt.method, tt.provided, tt.allowGetBody, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("methodWithBody(%s, %v, %v) = %s, %v, want %s", tt.method, tt.provided, tt.allowGetBody, got, err, tt.want)
+		}
+	}
+}
+
+func TestMethodAndBody(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		method string
+		body   string
+		query  string
+	}{
+		{"params only", []string{srv.URL, "a==1"}, 0, "GET", "", "a=1"},
+		{"body without a method", []string{srv.URL, "a=1"}, 0, "POST", `{"a":"1"}`, ""},
+		{"delete with body", []string{"DELETE", srv.URL, "id=7"}, 0, "DELETE", `{"id":"7"}`, ""},
+		{"delete with params", []string{"DELETE", srv.URL, "id==7"}, 0, "DELETE", "", "id=7"},
+		{"get with params", []string{"GET", srv.URL, "a==1", "b==2"}, 0, "GET", "", "a=1&b=2"},
+		{"get with body", []string{"GET", srv.URL, "a=1"}, 1, "", "", ""},
+		{"get with body allowed", []string{"-allow-get-body", "GET", srv.URL, "a=1"}, 0, "GET", `{"a":"1"}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if tt.method == "" {
+				if len(got) != 0 {
+					t.Errorf("server got %+v, want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(got))
+			}
+			if got[0].Method != tt.method || string(got[0].Body) != tt.body || got[0].RawQuery != tt.query {
+				t.Errorf("server got %s ?%s %q, want %s ?%s %q", got[0].Method, got[0].RawQuery, got[0].Body, tt.method, tt.query, tt.body)
+			}
+		})
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+
+	doc := map[string]interface{}{
+		"name":  "gopher",
+		"n":     42,
+		"pi":    3.5,
+		"ok":    true,
+		"tags":  []string{"a", "b"},
+		"raw":   []byte("hi"),
+		"inner": map[int]string{1: "one"},
+	}
+	packed, err := msgpack.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        []string
+	}{
+		{
+			name:        "msgpack",
+			contentType: "application/msgpack",
+			body:        packed,
+			want: []string{
+				`"name": "gopher"`, `"n": 42`, `"pi": 3.5`, `"ok": true`,
+				"\"tags\": [\n        \"a\",\n        \"b\"\n    ]",
+				`"raw": "aGk="`, `"1": "one"`,
+			},
+		},
+		{
+			name:        "x-msgpack",
+			contentType: "application/x-msgpack",
+			body:        packed,
+			want:        []string{`"name": "gopher"`},
+		},
+		{
+			name:        "undecodable",
+			contentType: "application/msgpack",
+			body:        []byte{0xc1, 'x'},
+			want:        []string{"binary data not shown"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := server(t, respond(tt.contentType, string(tt.body)))
+			r := gttp(t, "-body", srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(r.stdout, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+}
+
+// greetingDescriptor writes a FileDescriptorSet for
+//
+//	package test;
+//	message Greeting { string name = 1; int32 count = 2; Inner inner = 3; }
+//	message Inner { string v = 1; }
+//
+// and returns its path
+func greetingDescriptor(t *testing.T) string {
+	t.Helper()
+
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Greeting"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+					field("inner", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Inner"),
+				},
+			},
+			{
+				Name:  proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("v", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")},
+			},
+		},
+	}
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// greeting returns an encoded test.Greeting.  It's built by hand, rather
+// than with dynamicpb, so the fields come out in a fixed order.
+func greeting(name string, count int32, inner string) []byte {
+	var in []byte
+	in = protowire.AppendTag(in, 1, protowire.BytesType)
+	in = protowire.AppendString(in, inner)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(count))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, in)
+	return b
+}
+
+func TestProtobuf(t *testing.T) {
+
+	descriptor := greetingDescriptor(t)
+	srv, _ := server(t, respond("application/x-protobuf", string(greeting("gopher", 3, "deep"))))
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want []string
+	}{
+		{
+			name: "descriptor",
+			args: []string{"-proto-descriptor", descriptor, "-proto-message", "test.Greeting"},
+			want: []string{`"name": "gopher"`, `"count": 3`, "\"inner\": {\n        \"v\": \"deep\"\n    }"},
+		},
+		{
+			name: "raw",
+			want: []string{"1: \"gopher\"\n2: 3\n3: {\n    1: \"deep\"\n}\n"},
+		},
+		{
+			name: "unknown message",
+			args: []string{"-proto-descriptor", descriptor, "-proto-message", "test.Nope"},
+			code: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append(tt.args, "-body", srv.URL)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(r.stdout, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+
+	descriptor := greetingDescriptor(t)
+	message := greeting("gopher", 3, "deep")
+	bodyFile := writeFile(t, "greeting.bin", string(message))
+
+	trailers := "grpc-status: 0\r\ngrpc-message: OK\r\n"
+	trailerFrame := make([]byte, 5, 5+len(trailers))
+	trailerFrame[0] = 0x80
+	binary.BigEndian.PutUint32(trailerFrame[1:], uint32(len(trailers)))
+	trailerFrame = append(trailerFrame, trailers...)
+
+	// echo the framed message back, followed by the trailers
+	echo := func(text bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			framed, _ := io.ReadAll(r.Body)
+			out := append(framed, trailerFrame...)
+			if text {
+				w.Header().Set("Content-Type", "application/grpc-web-text+proto")
+				io.WriteString(w, base64.StdEncoding.EncodeToString(out))
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.Write(out)
+		}
+	}
+
+	srv, requests := server(t, echo(false))
+	textSrv, _ := server(t, echo(true))
+
+	tests := []struct {
+		name string
+		url  string
+		args []string
+		want []string
+	}{
+		{
+			name: "descriptor",
+			url:  srv.URL,
+			args: []string{"-proto-descriptor", descriptor, "-proto-message", "test.Greeting"},
+			want: []string{`"name": "gopher"`, `"count": 3`, "Grpc-Status: 0", "Grpc-Message: OK"},
+		},
+		{
+			name: "raw",
+			url:  srv.URL,
+			want: []string{"1: \"gopher\"\n2: 3\n", "Grpc-Status: 0"},
+		},
+		{
+			name: "text",
+			url:  textSrv.URL,
+			args: []string{"-proto-descriptor", descriptor, "-proto-message", "test.Greeting"},
+			want: []string{`"name": "gopher"`, "Grpc-Status: 0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append(tt.args, "-grpc-web", "-body-file", bodyFile, "-body", tt.url)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(r.stdout, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+
+	sent := requests()
+	if len(sent) == 0 {
+		t.Fatal("no requests sent")
+	}
+	req := sent[0]
+	if ct := req.Header.Get("Content-Type"); ct != "application/grpc-web+proto" {
+		t.Errorf("Content-Type = %q, want application/grpc-web+proto", ct)
+	}
+	if got := req.Header.Get("X-Grpc-Web"); got != "1" {
+		t.Errorf("X-Grpc-Web = %q, want 1", got)
+	}
+	if len(req.Body) < 5 || req.Body[0] != 0 || binary.BigEndian.Uint32(req.Body[1:5]) != uint32(len(message)) || !bytes.Equal(req.Body[5:], message) {
+		t.Errorf("request body isn't a single frame holding the message: %q", req.Body)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+
+	kvp, err := parseArgs([]string{
+		"a==1", "a=2", "a==3", "a=4",
+		"pics@a.png", "pics@b.png", "doc@c.txt",
+		"X-Foo:bar", "n:=5",
+		`k\=ey=v`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &kvpairs{
+		headers: map[string]string{"X-Foo": "bar"},
+		query:   map[string][]string{"a": {"1", "3"}},
+		body:    map[string][]string{"a": {"2", "4"}, "k=ey": {"v"}},
+		js:      map[string]string{"n": "5"},
+		file:    map[string][]string{"pics": {"a.png", "b.png"}, "doc": {"c.txt"}},
+	}
+	if !reflect.DeepEqual(kvp, want) {
+		t.Errorf("parseArgs = %+v, want %+v", kvp, want)
+	}
+
+	if _, err := parseArgs([]string{"nope"}); err == nil {
+		t.Error("parseArgs accepted an argument that isn't a key/value")
+	}
+}
+
+// sentPart is a part of a multipart body the test server received
+type sentPart struct {
+	Name, Filename, ContentType, Body string
+}
+
+// multipartParts parses the multipart body of req into its parts, in order
+func multipartParts(t *testing.T, req sentRequest) []sentPart {
+	t.Helper()
+
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(req.Body), params["boundary"])
+
+	var parts []sentPart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// FormName is only for form-data; related and mixed parts are attachments
+		_, disposition, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		parts = append(parts, sentPart{disposition["name"], p.FileName(), p.Header.Get("Content-Type"), string(b)})
+	}
+}
+
+func TestRepeatedFileField(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	a := writeFile(t, "a.txt", "first")
+	b := writeFile(t, "b.txt", "second")
+
+	r := gttp(t, srv.URL, "pics@"+a, "pics@"+b)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+
+	reqs := sent()
+	if len(reqs) != 1 {
+		t.Fatalf("server got %d requests, want 1", len(reqs))
+	}
+	got := multipartParts(t, reqs[0])
+	want := []sentPart{
+		{"pics", "a.txt", "application/octet-stream", "first"},
+		{"pics", "b.txt", "application/octet-stream", "second"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %+v, want %+v", got, want)
+	}
+}
+
+func TestRawBodyFile(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	raw := writeFile(t, "raw.bin", "raw body")
+	other := writeFile(t, "other.bin", "other body")
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		body string
+	}{
+		{"raw", []string{"-@" + raw}, 0, "raw body"},
+		{"two raw", []string{"-@" + raw, "-@" + other}, 1, ""},
+		{"raw and file", []string{"-@" + raw, "pics@" + other}, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, append([]string{srv.URL}, tt.args...)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if tt.code != 0 {
+				if len(got) != 0 {
+					t.Errorf("server got %+v, want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 || string(got[0].Body) != tt.body {
+				t.Fatalf("server got %+v, want one request with body %q", got, tt.body)
+			}
+			if ct := got[0].Header.Get("Content-Type"); strings.HasPrefix(ct, "multipart/") {
+				t.Errorf("raw body sent as %s", ct)
+			}
+		})
+	}
+}
+
+func TestJSONPart(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	doc := writeFile(t, "doc.txt", "contents")
+
+	r := gttp(t, "-json-part", "meta", srv.URL, "name=gopher", "n:=5", "doc@"+doc)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+
+	reqs := sent()
+	if len(reqs) != 1 {
+		t.Fatalf("server got %d requests, want 1", len(reqs))
+	}
+	got := multipartParts(t, reqs[0])
+	want := []sentPart{
+		{"meta", "", "application/json", `{"n":5,"name":"gopher"}`},
+		{"doc", "doc.txt", "application/octet-stream", "contents"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %+v, want %+v", got, want)
+	}
+}
+
+func TestUseColor(t *testing.T) {
+
+	// isTerminal only checks for a character device, which /dev/null is
+	tty, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tests := []struct {
+		force, no string
+		terminal  bool
+		want      bool
+	}{
+		{"", "", true, true},
+		{"", "", false, false},
+		{"", "1", true, false},
+		{"", "1", false, false},
+		{"1", "", true, true},
+		{"1", "", false, true},
+		{"1", "1", true, true},
+		{"1", "1", false, true},
+		{"true", "", false, true},
+		{"0", "", true, false},
+		{"0", "", false, false},
+		{"0", "1", true, false},
+		{"false", "", true, false},
+	}
+
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	for _, tt := range tests {
+		t.Setenv("FORCE_COLOR", tt.force)
+		t.Setenv("NO_COLOR", tt.no)
+		os.Stdout = file
+		if tt.terminal {
+			os.Stdout = tty
+		}
+		if got := useColor(); got != tt.want {
+			t.Errorf("FORCE_COLOR=%q NO_COLOR=%q terminal=%v: useColor() = %v, want %v", tt.force, tt.no, tt.terminal, got, tt.want)
+		}
+	}
+}
+
+func TestGetWithoutBody(t *testing.T) {
+
+	empty := writeFile(t, "empty", "")
+
+	tests := []struct {
+		name   string
+		given  string // the method argument, if any
+		items  []string
+		method string
+	}{
+		{"plain", "", nil, "GET"},
+		{"query", "", []string{"a==1"}, "GET"},
+		{"explicit", "GET", nil, "GET"},
+		{"head", "HEAD", nil, "HEAD"},
+		{"empty body file", "GET", []string{"-@" + empty}, "GET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, got := rawServer(t)
+
+			var args []string
+			if tt.given != "" {
+				args = append(args, tt.given)
+			}
+			r := gttp(t, append(append(args, u), tt.items...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+
+			raw := <-got
+			if !bytes.HasPrefix(raw, []byte(tt.method+" ")) {
+				t.Errorf("request wasn't a %s:\n%s", tt.method, raw)
+			}
+			for _, name := range headerNames(raw) {
+				switch http.CanonicalHeaderKey(name) {
+				case "Content-Length", "Transfer-Encoding":
+					t.Errorf("%s request sent with %s:\n%s", tt.method, name, raw)
+				}
+			}
+			if !bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+				t.Errorf("%s request sent with a body:\n%q", tt.method, raw)
+			}
+		})
+	}
+}
+
+func TestContentLengthValue(t *testing.T) {
+
+	empty := writeFile(t, "empty", "")
+
+	tests := []struct {
+		name    string
+		flags   []string
+		item    string
+		want    string // the Content-Length header sent
+		verbose string // what -v shows for it
+	}{
+		{"params", nil, "a=1", "9", "Content-Length: 9"},
+		{"empty POST", nil, "-@" + empty, "0", "Content-Length: 0"},
+		{"no content length", []string{"-no-content-length"}, "a=1", "", "Transfer-Encoding: chunked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, sent := server(t, nil)
+			r := gttp(t, append(append([]string{"-v"}, tt.flags...), "POST", srv.URL, tt.item)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+
+			reqs := sent()
+			if len(reqs) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(reqs))
+			}
+			if got := reqs[0].Header.Values("Content-Length"); tt.want == "" && len(got) != 0 || tt.want != "" && (len(got) != 1 || got[0] != tt.want) {
+				t.Errorf("Content-Length headers %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(r.stdout, tt.verbose) {
+				t.Errorf("verbose output doesn't show %q:\n%s", tt.verbose, r.stdout)
+			}
+		})
+	}
+}
+
+func TestExpectContentType(t *testing.T) {
+
+	srv, _ := server(t, respond("Application/JSON; charset=utf-8", `{"a":1}`))
+	noType, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+	})
+
+	tests := []struct {
+		name   string
+		url    string
+		expect string
+		code   int
+		stderr string
+	}{
+		{"match", srv.URL, "application/json", 0, ""},
+		{"parameters ignored", srv.URL, "application/json; charset=latin1", 0, ""},
+		{"case insensitive", srv.URL, "APPLICATION/json", 0, ""},
+		{"mismatch", srv.URL, "text/html", 1, "unexpected Content-Type"},
+		{"no content type", noType.URL, "application/json", 1, "unexpected Content-Type"},
+		{"bad type", srv.URL, "not a type", 1, "bad -expect-content-type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, "-expect-content-type", tt.expect, tt.url)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if !strings.Contains(r.stderr, tt.stderr) {
+				t.Errorf("stderr %q doesn't contain %q", r.stderr, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestGetHeader(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/elsewhere")
+		w.Header().Add("X-Multi", "one")
+		w.Header().Add("X-Multi", "two")
+		io.WriteString(w, "body")
+	})
+
+	tests := []struct {
+		name string
+		code int
+		want string
+	}{
+		{"Location", 0, "/elsewhere\n"},
+		{"location", 0, "/elsewhere\n"},
+		{"X-Multi", 0, "one\ntwo\n"},
+		{"X-Missing", 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, "-get-header", tt.name, srv.URL)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if r.stdout != tt.want {
+				t.Errorf("output %q, want %q", r.stdout, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteOut(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "hello")
+	})
+
+	r := gttp(t, "-write-out", `%{http_code} %{size_download} %{content_type} %{url_effective}\n`, srv.URL+"/path")
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	want := "202 5 text/plain " + srv.URL + "/path\n"
+	if !strings.HasSuffix(r.stdout, want) {
+		t.Errorf("output doesn't end with %q:\n%s", want, r.stdout)
+	}
+
+	r = gttp(t, "-write-out", `%{time_total}`, srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if !regexp.MustCompile(`\n\d+\.\d{6}$`).MatchString(r.stdout) {
+		t.Errorf("output doesn't end with a time:\n%s", r.stdout)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+
+	srv, sent := server(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if bytes.Contains(b, []byte("bad")) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	lines := writeFile(t, "lines.ndjson", "{\"n\":1}\n{\"n\":2}\n\n{\"n\":3}\n")
+	bad := writeFile(t, "bad.ndjson", "{\"n\":1}\n\"bad\"\n")
+
+	for _, concurrency := range []string{"1", "3"} {
+		t.Run("concurrency "+concurrency, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, "-ndjson", lines, "-concurrency", concurrency, srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+
+			var bodies []string
+			for _, req := range sent()[before:] {
+				if req.Method != "POST" {
+					t.Errorf("line sent with %s, want POST", req.Method)
+				}
+				bodies = append(bodies, string(req.Body))
+			}
+			sort.Strings(bodies)
+			if want := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}; !reflect.DeepEqual(bodies, want) {
+				t.Errorf("server got bodies %q, want %q", bodies, want)
+			}
+
+			for _, want := range []string{"line 1: 200 OK\n", "line 2: 200 OK\n", "line 4: 200 OK\n"} {
+				if !strings.Contains(r.stdout, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+
+	r := gttp(t, "-ndjson", bad, srv.URL)
+	if r.code != 1 {
+		t.Errorf("exit status %d with a failed line, want 1", r.code)
+	}
+	if !strings.Contains(r.stdout, "line 2: 400 Bad Request\n") {
+		t.Errorf("output doesn't show the failed line:\n%s", r.stdout)
+	}
+}
+
+func TestExpandPathParams(t *testing.T) {
+
+	tests := []struct {
+		u      string
+		params []string
+		args   []string
+		want   string
+		query  map[string][]string // what's left of the query parameters
+		err    bool
+	}{
+		{u: "https://example.com/users/{id}", args: []string{"id==42"}, want: "https://example.com/users/42", query: map[string][]string{}},
+		{u: "https://example.com/users/{id}", args: []string{"id=42"}, want: "https://example.com/users/42", query: map[string][]string{}},
+		{u: "https://example.com/users/{id}", params: []string{"id=7"}, args: []string{"id==42"}, want: "https://example.com/users/7", query: map[string][]string{"id": {"42"}}},
+		{u: "https://example.com/{a}/{b}?q={a}", params: []string{"a=x y", "b=z/w"}, want: "https://example.com/x%20y/z%2Fw?q={a}", query: map[string][]string{}},
+		{u: "https://example.com/{id}", args: []string{"id==1", "id==2"}, err: true},
+		{u: "https://example.com/users/{id}", err: true},
+		{u: "https://example.com/users/{id}", params: []string{"id"}, err: true},
+		{u: "https://example.com", want: "https://example.com", query: map[string][]string{}},
+	}
+
+	for _, tt := range tests {
+		kvp, err := parseArgs(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := expandPathParams(tt.u, tt.params, kvp)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expandPathParams(%q, %q, %q) = %q, want an error", tt.u, tt.params, tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandPathParams(%q, %q, %q): %v", tt.u, tt.params, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandPathParams(%q, %q, %q) = %q, want %q", tt.u, tt.params, tt.args, got, tt.want)
+		}
+		if !reflect.DeepEqual(kvp.query, tt.query) {
+			t.Errorf("expandPathParams(%q, %q, %q) left query %q, want %q", tt.u, tt.params, tt.args, kvp.query, tt.query)
+		}
+	}
+}
+
+func TestPathParams(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	r := gttp(t, srv.URL+"/users/{id}", "id==42", "x==1")
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	reqs := sent()
+	if len(reqs) != 1 || reqs[0].Path != "/users/42" || reqs[0].RawQuery != "x=1" {
+		t.Errorf("server got %+v, want /users/42?x=1", reqs)
+	}
+
+	r = gttp(t, srv.URL+"/users/{id}")
+	if r.code != 1 || !strings.Contains(r.stderr, "no value for path parameters: id") {
+		t.Errorf("exit status %d, stderr %q, want the missing parameter reported", r.code, r.stderr)
+	}
+	if len(sent()) != 1 {
+		t.Error("request sent with an unfilled placeholder")
+	}
+}
+
+func TestQueryFile(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		name     string
+		contents string
+		args     []string
+		code     int
+		want     string
+	}{
+		{"lines", "# shared\na=1\n\nb=two words\n", nil, 0, "a=1&b=two+words"},
+		{"repeated", "a=1\na=2\n", []string{"a==3"}, 0, "a=3&a=1&a=2"},
+		{"json", `{"a": 1, "b": ["x", "y"]}`, nil, 0, "a=1&b=x&b=y"},
+		{"bad line", "a=1\nnope\n", nil, 1, ""},
+		{"json array", `["a"]`, nil, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			file := writeFile(t, "query", tt.contents)
+			r := gttp(t, append([]string{"-query-file", file, srv.URL}, tt.args...)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if tt.code != 0 {
+				if len(got) != 0 {
+					t.Errorf("server got %+v, want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].RawQuery != tt.want {
+				t.Errorf("server got %+v, want query %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyFile(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		name        string
+		file        string
+		args        []string
+		contentType string
+	}{
+		{"json", "body.json", nil, "application/json"},
+		{"unknown extension", "body.unknownext", nil, "application/octet-stream"},
+		{"no extension", "body", nil, "application/octet-stream"},
+		{"overridden", "body.json", []string{"Content-Type:application/vnd.api+json"}, "application/vnd.api+json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			file := writeFile(t, tt.file, `{"a":1}`)
+			r := gttp(t, append([]string{"-body-file", file, srv.URL}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(got))
+			}
+			if got[0].Method != "POST" || string(got[0].Body) != `{"a":1}` {
+				t.Errorf("server got %s with body %q, want POST with the file", got[0].Method, got[0].Body)
+			}
+			if ct := got[0].Header.Values("Content-Type"); len(ct) != 1 || !strings.HasPrefix(ct[0], tt.contentType) {
+				t.Errorf("Content-Type %q, want %q", ct, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestBodySourceConflicts(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	raw := writeFile(t, "raw.bin", "raw")
+	other := writeFile(t, "other.bin", "other")
+	lines := writeFile(t, "lines.ndjson", "{}\n")
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"ndjson and params", []string{"-ndjson", lines, srv.URL, "a=1"}, "the bodies come from the -ndjson file"},
+		{"ndjson and raw", []string{"-ndjson", lines, srv.URL, "-@" + raw}, "the bodies come from the -ndjson file"},
+		{"raw and body file", []string{"-body-file", other, srv.URL, "-@" + raw}, "only one raw body allowed"},
+		{"raw and file", []string{srv.URL, "-@" + raw, "f@" + other}, "files can't be uploaded along with a raw body"},
+		{"body file and part", []string{"-body-file", raw, "-part", "f;=v", srv.URL}, "files can't be uploaded along with a raw body"},
+		{"raw and form param", []string{srv.URL, "-@" + raw, "a=1"}, "body parameters can't be sent along with a raw body"},
+		{"body file and json param", []string{"-body-file", raw, srv.URL, "a:=1"}, "body parameters can't be sent along with a raw body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, tt.args...)
+			if r.code != 1 {
+				t.Fatalf("exit status %d, want 1: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stderr, tt.err) {
+				t.Errorf("stderr %q doesn't contain %q", r.stderr, tt.err)
+			}
+		})
+	}
+
+	if got := sent(); len(got) != 0 {
+		t.Errorf("server got %+v, want nothing", got)
+	}
+}
+
+func TestHTMLSummary(t *testing.T) {
+
+	tests := []struct {
+		page        string
+		title       string
+		description string
+	}{
+		{`<html><head><title>A  Page
+			Title</title><meta name="Description" content=" About it "></head><body><title>not this</title></body></html>`, "A Page Title", "About it"},
+		{`<title>Only a title</title><p>text`, "Only a title", ""},
+		{`<meta name="keywords" content="k"><p>no title`, "", ""},
+		{`<title></title>`, "", ""},
+	}
+
+	for _, tt := range tests {
+		title, description := htmlSummary([]byte(tt.page))
+		if title != tt.title || description != tt.description {
+			t.Errorf("htmlSummary(%q) = %q, %q, want %q, %q", tt.page, title, description, tt.title, tt.description)
+		}
+	}
+}
+
+func TestHeadHTML(t *testing.T) {
+
+	page := `<html><head><title>Gophers</title><meta name="description" content="All about gophers"></head><body>lots of text</body></html>`
+	untitled := `<html><body>lots of text</body></html>`
+	srv, _ := server(t, respond("text/html; charset=utf-8", page))
+	untitledSrv, _ := server(t, respond("text/html", untitled))
+
+	r := gttp(t, "-head-html", srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if !strings.Contains(r.stdout, "\n\nGophers\nAll about gophers") || strings.Contains(r.stdout, "lots of text") {
+		t.Errorf("output isn't the title and description:\n%s", r.stdout)
+	}
+
+	r = gttp(t, "-head-html", untitledSrv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if !strings.Contains(r.stdout, "\n\n"+untitled) {
+		t.Errorf("untitled page isn't shown in full:\n%s", r.stdout)
+	}
+}
+
+func TestFollowMetaRefresh(t *testing.T) {
+
+	srv, sent := server(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first":
+			respond("text/html", `<html><head><meta http-equiv="Refresh" content="0; URL='/second?x=1'"></head></html>`)(w, r)
+		case "/loop":
+			respond("text/html", `<meta http-equiv="refresh" content="0;url=/loop">`)(w, r)
+		case "/reload":
+			respond("text/html", `<meta http-equiv="refresh" content="30">`)(w, r)
+		default:
+			io.WriteString(w, "arrived")
+		}
+	})
+
+	paths := func(reqs []sentRequest) []string {
+		var p []string
+		for _, r := range reqs {
+			p = append(p, r.Path)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		code  int
+		paths []string
+		shown string
+	}{
+		{"followed", []string{"-follow-meta-refresh", srv.URL + "/first"}, 0, []string{"/first", "/second"}, "\n\narrived"},
+		{"not asked for", []string{srv.URL + "/first"}, 0, []string{"/first"}, "http-equiv"},
+		{"reload", []string{"-follow-meta-refresh", srv.URL + "/reload"}, 0, []string{"/reload"}, "http-equiv"},
+		{"loop", []string{"-follow-meta-refresh", "-max-redirects", "2", srv.URL + "/loop"}, 1, []string{"/loop", "/loop", "/loop"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if p := paths(got); !reflect.DeepEqual(p, tt.paths) {
+				t.Errorf("server got %q, want %q", p, tt.paths)
+			}
+			if len(got) > 1 && got[1].Path == "/second" && got[1].RawQuery != "x=1" {
+				t.Errorf("refresh target fetched with query %q, want x=1", got[1].RawQuery)
+			}
+			if !strings.Contains(r.stdout, tt.shown) {
+				t.Errorf("output doesn't contain %q:\n%s", tt.shown, r.stdout)
+			}
+		})
+	}
+}
+
+func TestShowCookies(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc123; Path=/; Max-Age=3600; Secure; HttpOnly; SameSite=Lax")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=example.com; Expires=Wed, 21 Oct 2037 07:28:00 GMT")
+		w.Header().Add("Set-Cookie", "gone=; Max-Age=0")
+		w.Header().Set("X-Other", "kept")
+	})
+
+	r := gttp(t, "-show-cookies", srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	for _, want := range []string{
+		"Set-Cookie: session = abc123 (path=/ expires=1h0m0s Secure HttpOnly SameSite=Lax)\n",
+		"Set-Cookie: theme = dark (domain=example.com expires=2037-10-21T07:28:00Z)\n",
+		"Set-Cookie: gone =  (expires=now)\n",
+		"X-Other: kept\n",
+	} {
+		if !strings.Contains(r.stdout, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, r.stdout)
+		}
+	}
+	if strings.Contains(r.stdout, "Set-Cookie: session=") {
+		t.Errorf("raw Set-Cookie header shown as well:\n%s", r.stdout)
+	}
+
+	r = gttp(t, srv.URL)
+	if !strings.Contains(r.stdout, "Set-Cookie: session=abc123; Path=/") {
+		t.Errorf("Set-Cookie not shown raw without -show-cookies:\n%s", r.stdout)
+	}
+}
+
+func TestNetscapeJar(t *testing.T) {
+
+	u, _ := url.Parse("https://www.example.com/app/login")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	jar := &netscapeJar{}
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "abc", HttpOnly: true, Secure: true},
+		{Name: "wide", Value: "1", Domain: ".example.com", Path: "/", Expires: expires},
+		{Name: "expired", Value: "x", MaxAge: -1},
+		{Name: "elsewhere", Value: "x", Domain: "other.com"},
+	})
+
+	file := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := jar.save(file); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Netscape HTTP Cookie File\n" +
+		"#HttpOnly_www.example.com\tFALSE\t/app\tTRUE\t0\tsession\tabc\n" +
+		".example.com\tTRUE\t/\tFALSE\t" + strconv.FormatInt(expires.Unix(), 10) + "\twide\t1\n"
+	if string(b) != want {
+		t.Errorf("saved jar:\n%s\nwant:\n%s", b, want)
+	}
+
+	loaded := &netscapeJar{}
+	if err := loaded.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.cookies, jar.cookies[:2]) {
+		t.Errorf("loaded %+v, want %+v", loaded.cookies, jar.cookies[:2])
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"https://www.example.com/app/x", []string{"session=abc", "wide=1"}},
+		{"http://www.example.com/app/x", []string{"wide=1"}},
+		{"https://api.example.com/app/x", []string{"wide=1"}},
+		{"https://www.example.com/application", []string{"wide=1"}},
+		{"https://example.org/", nil},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		var got []string
+		for _, c := range loaded.Cookies(u) {
+			got = append(got, c.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Cookies(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	if err := loaded.load(writeFile(t, "bad.txt", "example.com\tFALSE\t/\n")); err == nil {
+		t.Error("loaded a cookie file with a short line")
+	}
+	if err := (&netscapeJar{}).load(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("loading a cookie file which doesn't exist yet: %v", err)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+
+	srv, sent := server(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		}
+	})
+	jar := filepath.Join(t.TempDir(), "cookies.txt")
+
+	if r := gttp(t, "-cookie-jar", jar, srv.URL+"/login"); r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if r := gttp(t, "-cookie", jar, srv.URL+"/account"); r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+
+	reqs := sent()
+	if len(reqs) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(reqs))
+	}
+	if got := reqs[1].Header.Get("Cookie"); got != "session=abc" {
+		t.Errorf("Cookie %q sent from the jar, want session=abc", got)
+	}
+}
+
+func TestCookieJarModes(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+	})
+	lines := writeFile(t, "lines.ndjson", "{\"a\":1}\n{\"a\":2}\n")
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"ndjson", []string{"-ndjson", lines, srv.URL + "/login"}},
+		{"diff", []string{"-diff", srv.URL + "/other", srv.URL + "/login"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jar := filepath.Join(t.TempDir(), "cookies.txt")
+			r := gttp(t, append([]string{"-cookie-jar", jar}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			saved, err := os.ReadFile(jar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(saved), "\tsession\tabc\n") {
+				t.Errorf("cookie not saved to the jar:\n%s", saved)
+			}
+		})
+	}
+}
+
+func TestWaitNotice(t *testing.T) {
+
+	slow, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	fast, _ := server(t, nil)
+
+	tests := []struct {
+		name    string
+		args    []string
+		notices bool
+		shown   string // the deadline shown, if any
+	}{
+		{"slow", []string{"-v", "-wait-notice", "50ms", "-t", "5s", slow.URL}, true, "deadline: "},
+		{"slow, not verbose", []string{"-wait-notice", "50ms", slow.URL}, false, ""},
+		{"fast", []string{"-v", "-wait-notice", "1s", fast.URL}, false, ""},
+		{"deadline", []string{"-v", "-deadline", "2099-01-02T03:04:05Z", fast.URL}, false, "deadline: 2099-01-02T03:04:05Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, tt.args...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if got := strings.Contains(r.stderr, "still waiting ("); got != tt.notices {
+				t.Errorf("still waiting notices %v, want %v: %s", got, tt.notices, r.stderr)
+			}
+			if tt.shown == "" && strings.Contains(r.stderr, "deadline: ") {
+				t.Errorf("deadline shown without one:\n%s", r.stderr)
+			}
+			if !strings.Contains(r.stderr, tt.shown) {
+				t.Errorf("stderr doesn't contain %q:\n%s", tt.shown, r.stderr)
+			}
+		})
+	}
+}
+
+func TestInterface(t *testing.T) {
+
+	remotes := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remotes <- host
+	}))
+	defer srv.Close()
+
+	type test struct {
+		name  string
+		iface string
+		want  string
+	}
+	tests := []test{
+		{"address", "127.0.0.1", "127.0.0.1"},
+	}
+	if runtime.GOOS == "linux" {
+		// all of 127/8 is on the loopback interface, so this shows the
+		// address really is the one used rather than the default
+		tests = append(tests, test{"other loopback address", "127.0.0.2", "127.0.0.2"})
+	}
+	if _, err := net.InterfaceByName("lo"); err == nil {
+		tests = append(tests, test{"interface name", "lo", "127.0.0.1"})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, "-interface", tt.iface, srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if got := <-remotes; got != tt.want {
+				t.Errorf("request came from %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	r := gttp(t, "-interface", "no-such-interface0", srv.URL)
+	if r.code != 1 || !strings.Contains(r.stderr, "bad -interface") {
+		t.Errorf("exit status %d, stderr %q, want a bad -interface error", r.code, r.stderr)
+	}
+}
+
+func TestFallbackDelay(t *testing.T) {
+
+	srv4, _ := server(t, nil)
+	urls := map[string]string{"IPv4": srv4.URL}
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		srv6 := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}}
+		srv6.Start()
+		defer srv6.Close()
+		urls["IPv6"] = srv6.URL
+	}
+
+	for family, u := range urls {
+		for _, delay := range []string{"50ms", "-1ns"} {
+			t.Run(family+" "+delay, func(t *testing.T) {
+				r := gttp(t, "-v", "-fallback-delay", delay, u)
+				if r.code != 0 {
+					t.Fatalf("exit status %d: %s", r.code, r.stderr)
+				}
+				want := "connected to " + strings.TrimPrefix(u, "http://") + " (" + family + ")"
+				if !strings.Contains(r.stderr, want) {
+					t.Errorf("stderr doesn't contain %q:\n%s", want, r.stderr)
+				}
+			})
+		}
+	}
+
+	if r := gttp(t, "-fallback-delay", "soon", srv4.URL); r.code == 0 {
+		t.Error("bad -fallback-delay accepted")
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+
+	tests := []struct {
+		keepAlive, fallbackDelay time.Duration
+	}{
+		{30 * time.Second, 0},
+		{5 * time.Second, 50 * time.Millisecond},
+		{-1, -1},
+	}
+
+	for _, tt := range tests {
+		d := newDialer(tt.keepAlive, tt.fallbackDelay)
+		if d.KeepAlive != tt.keepAlive || d.FallbackDelay != tt.fallbackDelay || d.Timeout != 30*time.Second {
+			t.Errorf("newDialer(%v, %v) = %+v", tt.keepAlive, tt.fallbackDelay, d)
+		}
+	}
+
+	// and the flags get there: a bad interval is refused, a good one works
+	srv, _ := server(t, nil)
+	for _, keepAlive := range []string{"1s", "-1ns"} {
+		if r := gttp(t, "-keepalive", keepAlive, srv.URL); r.code != 0 {
+			t.Errorf("-keepalive %s: exit status %d: %s", keepAlive, r.code, r.stderr)
+		}
+	}
+	if r := gttp(t, "-keepalive", "often", srv.URL); r.code == 0 {
+		t.Error("bad -keepalive accepted")
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"application/vnd.api+json", true},
+		{"application/hal+json", true},
+		{"application/problem+json; charset=utf-8", true},
+		{"text/json", true},
+		{"application/jsonp", false},
+		{"application/json-seq", false},
+		{"application/x-ndjson", false},
+		{"text/html", false},
+		{"", false},
+		{"not a type", false},
+	}
+
+	for _, tt := range tests {
+		if got := isJSON(tt.contentType); got != tt.want {
+			t.Errorf("isJSON(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestJSONSuffixFormatted(t *testing.T) {
+
+	for _, contentType := range []string{"application/vnd.api+json", "application/hal+json"} {
+		t.Run(contentType, func(t *testing.T) {
+			srv, _ := server(t, respond(contentType, `{"a":[1,2]}`))
+			r := gttp(t, srv.URL)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if want := "\n\n{\n    \"a\": [\n        1,\n        2\n    ]\n}\n"; !strings.Contains(r.stdout, want) {
+				t.Errorf("output isn't formatted JSON:\n%s", r.stdout)
+			}
+		})
+	}
+}
+
+func TestJSONLinks(t *testing.T) {
+
+	tests := []struct {
+		name string
+		doc  string
+		want []hypermediaLink
+	}{
+		{
+			name: "HAL",
+			doc: `{"_links": {
+				"self": {"href": "/orders/1"},
+				"next": {"href": "/orders/2"},
+				"item": [{"href": "/items/a"}, {"href": "/items/b"}],
+				"curies": [{"name": "doc", "templated": true}]
+			}, "total": 2}`,
+			want: []hypermediaLink{{"item", "/items/a"}, {"item", "/items/b"}, {"next", "/orders/2"}, {"self", "/orders/1"}},
+		},
+		{
+			name: "JSON:API",
+			doc:  `{"links": {"self": "/articles", "next": {"href": "/articles?page=2", "meta": {}}}, "data": []}`,
+			want: []hypermediaLink{{"next", "/articles?page=2"}, {"self", "/articles"}},
+		},
+		{name: "no links", doc: `{"links": ["/a"], "data": {}}`},
+		{name: "array", doc: `[{"_links": {"self": "/x"}}]`},
+	}
+
+	for _, tt := range tests {
+		j, err := decodeJSON([]byte(tt.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := jsonLinks(j); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: jsonLinks = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShowLinks(t *testing.T) {
+
+	srv, _ := server(t, respond("application/hal+json", `{"_links": {"self": {"href": "/orders/1"}, "next": {"href": "/orders/2"}}}`))
+
+	r := gttp(t, "-links", srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if want := "}\n\nnext: /orders/2\nself: /orders/1"; !strings.Contains(r.stdout, want) {
+		t.Errorf("output doesn't list the links after the body:\n%s", r.stdout)
+	}
+
+	r = gttp(t, srv.URL)
+	if strings.Contains(r.stdout, "next: /orders/2") {
+		t.Errorf("links listed without -links:\n%s", r.stdout)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		case "/c":
+			// back to the same path, but a different URL
+			if r.URL.RawQuery == "" {
+				http.Redirect(w, r, "/c?again=1", http.StatusFound)
+			} else {
+				http.Redirect(w, r, "/done", http.StatusFound)
+			}
+		case "/n":
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			http.Redirect(w, r, "/n?n="+strconv.Itoa(n+1), http.StatusFound)
+		default:
+			io.WriteString(w, "arrived")
+		}
+	})
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"loop", []string{srv.URL + "/a"}, 1, "redirect loop: " + srv.URL + "/a -> " + srv.URL + "/b -> " + srv.URL + "/a"},
+		{"same path", []string{srv.URL + "/c"}, 0, ""},
+		{"endless", []string{"-max-redirects", "3", srv.URL + "/n"}, 1, "stopped after 3 redirects"},
+		{"arrives", []string{srv.URL + "/elsewhere"}, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			if !strings.Contains(r.stderr, tt.stderr) {
+				t.Errorf("stderr doesn't contain %q:\n%s", tt.stderr, r.stderr)
+			}
+		})
+	}
+}
+
+func TestMethodFlag(t *testing.T) {
+
+	srv, sent := server(t, nil)
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		method string
+		body   string
+	}{
+		{"report", []string{"-X", "REPORT", srv.URL}, 0, "REPORT", ""},
+		{"long form", []string{"-method", "MKCOL", srv.URL}, 0, "MKCOL", ""},
+		{"custom", []string{"-X", "X-CUSTOM_1", srv.URL}, 0, "X-CUSTOM_1", ""},
+		{"standard lower case", []string{"-X", "put", srv.URL}, 0, "PUT", ""},
+		{"with body", []string{"-X", "REPORT", srv.URL, "a=1"}, 0, "REPORT", `{"a":"1"}`},
+		{"lower case", []string{"-X", "report", srv.URL}, 1, "", ""},
+		{"not a token", []string{"-X", "RE PORT", srv.URL}, 1, "", ""},
+		{"given twice", []string{"-X", "REPORT", "PUT", srv.URL}, 1, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			got := sent()[before:]
+			if tt.method == "" {
+				if len(got) != 0 {
+					t.Errorf("server got %+v, want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Method != tt.method || string(got[0].Body) != tt.body {
+				t.Errorf("server got %+v, want one %s with body %q", got, tt.method, tt.body)
+			}
+		})
+	}
+}
+
+func TestLooksLikeURL(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"example.com", true},
+		{"https://x", true},
+		{"localhost", true},
+		{"localhost:8080", true},
+		{"example.com:8080", true},
+		{"10.0.0.1:80/path", true},
+		{"[::1]:8080", true},
+		{"x:1", false},
+		{"X-Count:5", false},
+		{"Accept:text/html", false},
+		{"a==1", false},
+		{"a=1", false},
+		{"n:=5", false},
+		{"f@file", false},
+	}
+
+	for _, tt := range tests {
+		if got := looksLikeURL(tt.s); got != tt.want {
+			t.Errorf("looksLikeURL(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMethodDetection(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		want string // the equivalent HTTPie command
+	}{
+		{[]string{"LINK", "example.com"}, "http LINK https://example.com"},
+		{[]string{"REPORT", "localhost:8080"}, "http REPORT https://localhost:8080"},
+		{[]string{"REPORT", "10.0.0.1:80"}, "http REPORT https://10.0.0.1:80"},
+		{[]string{"PROPFIND", "https://x", "Depth:1"}, "http PROPFIND https://x Depth:1"},
+		{[]string{"post", "example.com", "x:1"}, "http POST https://example.com x:1"},
+		{[]string{"get", "x:1"}, "http GET https://x:1"},
+		// an upper-case host name, not a method
+		{[]string{"MYHOST", "x:1"}, "http https://MYHOST x:1"},
+		{[]string{"MYHOST", "a==1"}, "http https://MYHOST a==1"},
+		{[]string{"MYHOST"}, "http https://MYHOST"},
+		{[]string{"EXAMPLE.COM", "a==1"}, "http https://EXAMPLE.COM a==1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			r := gttp(t, append([]string{"-as-httpie"}, tt.args...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if got := strings.TrimSpace(r.stdout); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSResume(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr []string
+	}{
+		{"resumed", []string{"-session-resume"}, 0, []string{"TLS session resumed: true"}},
+		{"not resumed", []string{"-session-resume", "-no-tls-resume"}, 1, []string{"TLS session resumed: false"}},
+		{"verbose", []string{"-v", "-session-resume"}, 0, []string{"TLS session resumed: false", "TLS session resumed: true"}},
+		{"single request", []string{"-v"}, 0, []string{"TLS session resumed: false"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append(append([]string{"-k"}, tt.args...), srv.URL)...)
+			if r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			// in order
+			rest := r.stderr
+			for _, want := range tt.stderr {
+				i := strings.Index(rest, want)
+				if i < 0 {
+					t.Fatalf("stderr doesn't contain %q in order:\n%s", tt.stderr, r.stderr)
+				}
+				rest = rest[i+len(want):]
+			}
+			if strings.Contains(rest, "TLS session resumed") {
+				t.Errorf("more resumption reports than %q:\n%s", tt.stderr, r.stderr)
+			}
+		})
+	}
+}
+
+func TestShortStatus(t *testing.T) {
+
+	tests := []struct {
+		status string
+		code   int
+		want   string
+	}{
+		{"200 OK", 200, "HTTP/1.1 200 OK\n"},
+		{"200", 200, "HTTP/1.1 200\n"},
+		{"2", 200, "HTTP/1.1 200 2\n"},
+		{"", 200, "HTTP/1.1 200\n"},
+		{"OK", 200, "HTTP/1.1 200 OK\n"},
+		{"404 Not Found", 404, "HTTP/1.1 404 Not Found\n"},
+	}
+
+	defer func(w io.Writer) { stdout = w }(stdout)
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		stdout = &buf
+		printResponseHeaders(false, &http.Response{Proto: "HTTP/1.1", Status: tt.status, StatusCode: tt.code, Header: http.Header{}}, false)
+		if got, _, _ := strings.Cut(buf.String(), "\n"); got+"\n" != tt.want {
+			t.Errorf("status %q: got %q, want %q", tt.status, got+"\n", tt.want)
+		}
+	}
+}
+
+func TestStatusWithoutReason(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 299\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+
+	r := gttp(t, "http://"+ln.Addr().String())
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if !strings.HasPrefix(r.stdout, "HTTP/1.1 299\n") || !strings.Contains(r.stdout, "\n\nok") {
+		t.Errorf("output:\n%q", r.stdout)
+	}
+}
+
+func TestALPN(t *testing.T) {
+
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	defer h1.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		args     []string
+		reported string // what's said about the negotiated protocol
+		proto    string // the HTTP version the server saw
+	}{
+		{"default", h2.URL, nil, "negotiated protocol: h2", "HTTP/2.0"},
+		{"h2", h2.URL, []string{"-alpn", "h2"}, "negotiated protocol: h2", "HTTP/2.0"},
+		{"preferring http/1.1", h2.URL, []string{"-alpn", "http/1.1,h2"}, "negotiated protocol: h2", "HTTP/2.0"},
+		{"server without h2", h1.URL, []string{"-alpn", "h2,http/1.1"}, "negotiated protocol: http/1.1", "HTTP/1.1"},
+		{"http/1.1 only", h1.URL, []string{"-alpn", "http/1.1"}, "negotiated protocol: http/1.1", "HTTP/1.1"},
+		// the h2 server offers nothing else, so nothing is agreed on
+		{"no overlap", h2.URL, []string{"-alpn", "http/1.1"}, "no protocol negotiated with ALPN", "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gttp(t, append(append([]string{"-v", "-k"}, tt.args...), tt.url)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stderr, tt.reported+"\n") {
+				t.Errorf("stderr doesn't contain %q:\n%s", tt.reported, r.stderr)
+			}
+			if !strings.HasSuffix(strings.TrimSpace(r.stdout), "\n\n"+tt.proto) {
+				t.Errorf("server saw a request other than %s:\n%s", tt.proto, r.stdout)
+			}
+		})
+	}
+}
+
+// encode compresses s with the Content-Encoding encoding
+func encode(t *testing.T, encoding, s string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br", "BR":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	io.WriteString(w, s)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodingServer responds with a JSON body compressed with the encoding
+// named by the path, whatever the request asked for
+func encodingServer(t *testing.T) (*httptest.Server, func() []sentRequest) {
+	t.Helper()
+
+	return server(t, func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.TrimPrefix(r.URL.Path, "/")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(encode(t, encoding, `{"encoded":"`+encoding+`"}`))
+	})
+}
+
+func TestCompressed(t *testing.T) {
+
+	srv, sent := encodingServer(t)
+
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, "-compressed", srv.URL+"/"+encoding)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 || got[0].Header.Get("Accept-Encoding") != "gzip, deflate, br" {
+				t.Errorf("server got %+v, want Accept-Encoding: gzip, deflate, br", got)
+			}
+			if want := "\n\n{\n    \"encoded\": \"" + encoding + "\"\n}"; !strings.Contains(r.stdout, want) {
+				t.Errorf("body not decoded:\n%s", r.stdout)
+			}
+			if !strings.Contains(r.stdout, "Content-Encoding: "+encoding) {
+				t.Errorf("Content-Encoding header not shown:\n%s", r.stdout)
+			}
+		})
+	}
+}
+
+func TestBrotliWithoutCompressed(t *testing.T) {
+
+	srv, sent := encodingServer(t)
+
+	for _, encoding := range []string{"br", "BR"} {
+		t.Run(encoding, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, srv.URL+"/"+encoding)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 || strings.Contains(got[0].Header.Get("Accept-Encoding"), "br") {
+				t.Errorf("server got %+v, want br not asked for", got)
+			}
+			if want := "\n\n{\n    \"encoded\": \"" + encoding + "\"\n}"; !strings.Contains(r.stdout, want) {
+				t.Errorf("brotli body not decoded:\n%s", r.stdout)
+			}
+		})
+	}
+}
+
+func TestURLEncodeData(t *testing.T) {
+
+	file := writeFile(t, "content", "a b&c=d\n")
+
+	tests := []struct {
+		arg  string
+		want string
+		err  bool
+	}{
+		{"plain content", "plain+content", false},
+		{"=a b&c", "a+b%26c", false},
+		{"=has=equals", "has%3Dequals", false},
+		{"name=a b&c", "name=a+b%26c", false},
+		{"name=", "name=", false},
+		{"name=x@y", "name=x%40y", false},
+		{"@" + file, "a+b%26c%3Dd%0A", false},
+		{"name@" + file, "name=a+b%26c%3Dd%0A", false},
+		{"name@" + file + ".missing", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := urlEncodeData(tt.arg)
+		if tt.err {
+			if err == nil {
+				t.Errorf("urlEncodeData(%q) = %q, want an error", tt.arg, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("urlEncodeData(%q) = %q, %v, want %q", tt.arg, got, err, tt.want)
+		}
+	}
+}
+
+func TestDataURLEncode(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	file := writeFile(t, "content", "from a file")
+
+	tests := []struct {
+		name  string
+		flags []string
+		items []string
+		body  string
+	}{
+		{"name=value", []string{"-data-urlencode", "q=a b&c"}, nil, "q=a+b%26c"},
+		{"=value", []string{"-data-urlencode", "=a b"}, nil, "a+b"},
+		{"name@file", []string{"-data-urlencode", "f@" + file}, nil, "f=from+a+file"},
+		{"@file", []string{"-data-urlencode", "@" + file}, nil, "from+a+file"},
+		{"repeated", []string{"-data-urlencode", "a=1", "-data-urlencode", "a=2"}, nil, "a=1&a=2"},
+		{"with body params", []string{"-data-urlencode", "b=x y"}, []string{"a=1"}, "a=1&b=x+y"},
+		{"with files as fields", []string{"-m=false", "-data-urlencode", "b=x y"}, []string{"f@" + file}, "f=from+a+file&b=x+y"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, append(append(tt.flags, srv.URL), tt.items...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			got := sent()[before:]
+			if len(got) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(got))
+			}
+			if got[0].Method != "POST" || string(got[0].Body) != tt.body {
+				t.Errorf("server got %s with body %q, want POST with %q", got[0].Method, got[0].Body, tt.body)
+			}
+			if ct := got[0].Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+				t.Errorf("Content-Type %q, want application/x-www-form-urlencoded", ct)
+			}
+		})
+	}
+
+	raw := writeFile(t, "raw", "raw")
+	lines := writeFile(t, "lines.ndjson", "{}\n")
+
+	rejected := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"raw body", []string{"-data-urlencode", "a=1", srv.URL, "-@" + raw}, "-data-urlencode fields can't be sent along with a raw body"},
+		{"multipart", []string{"-data-urlencode", "a=1", srv.URL, "f@" + file}, "-data-urlencode fields can't be sent in a multipart body"},
+		{"multipart type", []string{"-data-urlencode", "a=1", "-multipart-type", "related", srv.URL, "f@" + file}, "-data-urlencode fields can't be sent in a multipart body"},
+		{"part", []string{"-data-urlencode", "a=1", "-part", "f;=v", srv.URL}, "-data-urlencode fields can't be sent in a multipart body"},
+		{"ndjson", []string{"-data-urlencode", "a=1", "-ndjson", lines, srv.URL}, "the bodies come from the -ndjson file"},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, tt.args...)
+			if r.code != 1 {
+				t.Errorf("exit status %d, want 1", r.code)
+			}
+			if !strings.Contains(r.stderr, tt.err) {
+				t.Errorf("stderr doesn't contain %q:\n%s", tt.err, r.stderr)
+			}
+			if n := len(sent()) - before; n != 0 {
+				t.Errorf("server got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestRepeatedFileFieldParts(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	dir := t.TempDir()
+	files := map[string]string{"a.png": "png", "b.txt": "text", "c.json": "{}"}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := []string{
+		"pics@" + filepath.Join(dir, "a.png"),
+		"pics@" + filepath.Join(dir, "b.txt"),
+		"doc@" + filepath.Join(dir, "c.json"),
+	}
+
+	for _, subtype := range []string{"form-data", "related", "mixed"} {
+		t.Run(subtype, func(t *testing.T) {
+			before := len(sent())
+			r := gttp(t, append([]string{"-multipart-type", subtype, srv.URL}, items...)...)
+			if r.code != 0 {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			reqs := sent()[before:]
+			if len(reqs) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(reqs))
+			}
+			if ct := reqs[0].Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/"+subtype+";") {
+				t.Errorf("Content-Type %q, want multipart/%s", ct, subtype)
+			}
+
+			// one part per file, whatever order the fields come in
+			var got []string
+			for _, p := range multipartParts(t, reqs[0]) {
+				got = append(got, p.Name+" "+p.Filename+" "+p.Body)
+			}
+			sort.Strings(got)
+			want := []string{"doc c.json {}", "pics a.png png", "pics b.txt text"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parts %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSignCmdModes(t *testing.T) {
+
+	srv, sent := server(t, nil)
+	other, otherSent := server(t, nil)
+	lines := writeFile(t, "lines.ndjson", "{\"n\":1}\n{\"n\":2}\n")
+	// signs with a hash of the request it's given, which includes the body
+	sign := `echo "X-Signature: $(cksum | cut -d" " -f1)"; echo "X-Signed-URL: $GTTP_URL"`
+
+	checkSigned := func(t *testing.T, reqs []sentRequest, n int) {
+		t.Helper()
+		if len(reqs) != n {
+			t.Fatalf("server got %d requests, want %d", len(reqs), n)
+		}
+		seen := make(map[string]bool)
+		for _, req := range reqs {
+			sig := req.Header.Get("X-Signature")
+			if sig == "" || req.Header.Get("X-Signed-URL") == "" {
+				t.Errorf("request to %s with body %q wasn't signed", req.Path, req.Body)
+			}
+			seen[sig] = true
+		}
+		if len(seen) != n {
+			t.Errorf("%d requests share signatures: %+v", n, reqs)
+		}
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		r := gttp(t, "-sign-cmd", sign, "-ndjson", lines, srv.URL)
+		if r.code != 0 {
+			t.Fatalf("exit status %d: %s", r.code, r.stderr)
+		}
+		checkSigned(t, sent(), 2)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		before := len(sent())
+		r := gttp(t, "-sign-cmd", sign, "-diff", other.URL+"/b", srv.URL+"/a")
+		if r.code != 0 {
+			t.Fatalf("exit status %d: %s", r.code, r.stderr)
+		}
+		reqs := append(sent()[before:], otherSent()...)
+		checkSigned(t, reqs, 2)
+		for _, req := range reqs {
+			if !strings.HasSuffix(req.Header.Get("X-Signed-URL"), req.Path) {
+				t.Errorf("request to %s signed for %s", req.Path, req.Header.Get("X-Signed-URL"))
+			}
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		before := len(sent())
+		r := gttp(t, "-sign-cmd", "exit 1", "-ndjson", lines, srv.URL)
+		if r.code != 1 {
+			t.Errorf("exit status %d, want 1", r.code)
+		}
+		if got := sent()[before:]; len(got) != 0 {
+			t.Errorf("unsigned requests sent: %+v", got)
+		}
+	})
+}
+
+func TestIntervalInterrupt(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGINT to send")
+	}
+
+	srv, _ := server(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		io.WriteString(w, "polled")
+	})
+
+	// interrupt runs gttp with args and sends it SIGINT after delay
+	interrupt := func(t *testing.T, delay time.Duration, args ...string) (string, *os.ProcessState, time.Duration) {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "GTTP_TEST_MAIN=1", "NO_COLOR=", "FORCE_COLOR=", "SSLKEYLOGFILE=")
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		start := time.Now()
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(delay)
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+		return stdout.String(), cmd.ProcessState, time.Since(start)
+	}
+
+	t.Run("during a request", func(t *testing.T) {
+		out, state, took := interrupt(t, 500*time.Millisecond, "-interval", "100ms", srv.URL+"/slow")
+		if state.Success() {
+			t.Errorf("exited successfully after an interrupted request:\n%s", out)
+		}
+		if took > 3*time.Second {
+			t.Errorf("took %s to stop; the request wasn't interrupted", took)
+		}
+		if strings.Contains(out, "polled") {
+			t.Errorf("interrupted response shown:\n%s", out)
+		}
+	})
+
+	t.Run("between requests", func(t *testing.T) {
+		out, state, _ := interrupt(t, 500*time.Millisecond, "-interval", "10s", srv.URL)
+		if !state.Success() {
+			t.Errorf("exit status %d after stopping polling", state.ExitCode())
+		}
+		if !strings.Contains(out, "\n\npolled") {
+			t.Errorf("first response not shown:\n%s", out)
+		}
+	})
+}
+
+func TestPrintMarkdown(t *testing.T) {
+
+	doc := "# Title\n\nSome `code` and a [link](https://example.com).\n\n```\n# not a heading\n```\n###### Small\n#nospace\n"
+	want := "\x1b[1m# Title\x1b[0m\n" +
+		"\n" +
+		"Some \x1b[2m`code`\x1b[0m and a \x1b[4mlink\x1b[0m (\x1b[2mhttps://example.com\x1b[0m).\n" +
+		"\n" +
+		"\x1b[2m```\x1b[0m\n" +
+		"\x1b[2m# not a heading\x1b[0m\n" +
+		"\x1b[2m```\x1b[0m\n" +
+		"\x1b[1m###### Small\x1b[0m\n" +
+		"#nospace\n"
+
+	defer func(w io.Writer) { stdout = w }(stdout)
+	var buf bytes.Buffer
+	stdout = &buf
+	printMarkdown([]byte(doc))
+	if buf.String() != want {
+		t.Errorf("printMarkdown:\n%q\nwant:\n%q", buf.String(), want)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+
+	srv, _ := server(t, respond("text/markdown; charset=utf-8", "# Title\ntext\n"))
+
+	r := gttp(t, "-render-markdown", "-color", srv.URL)
+	if r.code != 0 {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	if !strings.Contains(r.stdout, "\x1b[1m# Title\x1b[0m\ntext\n") {
+		t.Errorf("heading not styled:\n%q", r.stdout)
+	}
+
+	// only with color
+	r = gttp(t, "-render-markdown", srv.URL)
+	if !strings.Contains(r.stdout, "\n\n# Title\ntext\n") {
+		t.Errorf("markdown changed without color:\n%q", r.stdout)
+	}
+}